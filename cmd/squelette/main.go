@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
@@ -13,21 +14,33 @@ import (
 	"time"
 
 	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/devcert"
+	"github.com/shivanshkc/squelette/internal/listener"
 	"github.com/shivanshkc/squelette/internal/logger"
 	"github.com/shivanshkc/squelette/internal/rest"
+	"github.com/shivanshkc/squelette/internal/upgrade"
 )
 
 func main() {
+	// Subcommands are dispatched before the server flags are parsed.
+	if len(os.Args) > 1 && os.Args[1] == "dev-cert" {
+		runDevCert(os.Args[2:])
+		return
+	}
+
 	// This is the root context of the app.
-	// It is canceled in two cases:
-	// 	- If an interruption is detected, or
-	//	- If a fatal error occurs that requires the app to exit.
+	// It is canceled in three cases:
+	// 	- If an interruption is detected,
+	//	- If a fatal error occurs that requires the app to exit, or
+	//	- If a new process has taken over after a binary upgrade.
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	// Allow the user to specify the config path.
 	// This makes switching between test and live configs convenient.
 	configPath := flag.String("config", "config/config.json", "config file path")
+	// Serve HTTPS using the certificate generated by the "dev-cert" subcommand. For local development only.
+	devTLS := flag.Bool("dev-tls", false, "serve HTTPS using the certificate generated by the dev-cert command")
 	flag.Parse()
 
 	// Very first dependency of the app.
@@ -46,22 +59,58 @@ func main() {
 	// Set up the API handlers.
 	handler := rest.NewHandler(conf)
 
-	// The REST API server of the app.
-	httpServer := makeHttpServer(ctx, conf.HttpServer.Addr, handler)
+	// If this process was started by a binary upgrade, it must serve on the sockets handed over by the old process.
+	sockets, err := upgrade.Inherited()
+	if err != nil {
+		panic("failed to use inherited listeners: " + err.Error())
+	}
 
-	go func() {
-		// Signal the app to exit if the http server stops.
-		// This is fine even if the server is stopped by the cleanup function.
-		defer cancel()
+	// Otherwise, open all the sockets that the server will accept connections on.
+	if len(sockets) == 0 {
+		sockets, err = listener.Listen(conf.HttpServer.Listen, conf.HttpServer.UnixSocketPerm)
+		if err != nil {
+			panic("failed to open listeners: " + err.Error())
+		}
+	}
 
-		slog.InfoContext(ctx, "starting the http server", "addr", conf.HttpServer.Addr)
+	// Wrapped so they can be handed over to a new process upon upgrade.
+	listeners := upgrade.Wrap(sockets)
 
-		// Start listening.
-		err := httpServer.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.ErrorContext(ctx, "error in ListenAndServe call", "error", err)
-		}
-	}()
+	// The REST API server of the app.
+	httpServer := makeHttpServer(ctx, conf, handler)
+	// Event streams never go idle, so they are ended as soon as the shutdown starts.
+	httpServer.RegisterOnShutdown(handler.CloseStreams)
+
+	// All listeners are served by the same server, so they share the handler and get shut down together.
+	for _, l := range listeners {
+		go func() {
+			// Signal the app to exit if the http server stops on any of the listeners.
+			// This is fine even if the server is stopped by the cleanup function.
+			defer cancel()
+
+			addr := l.Addr().Network() + "://" + l.Addr().String()
+			slog.InfoContext(ctx, "starting the http server", "addr", addr, "devTLS", *devTLS)
+
+			// Start serving.
+			var err error
+			if *devTLS {
+				err = httpServer.ServeTLS(l, devcert.CertPath(devcert.DefaultDir), devcert.KeyPath(devcert.DefaultDir))
+			} else {
+				err = httpServer.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.ErrorContext(ctx, "error in Serve call", "addr", addr, "error", err)
+			}
+		}()
+	}
+
+	// Let the old process (if any) know that it can start draining.
+	if err := upgrade.Ready(); err != nil {
+		slog.ErrorContext(ctx, "failed to report readiness to the old process", "error", err)
+	}
+
+	// Upgrade to the binary on disk without dropping connections whenever SIGUSR2 is received.
+	go handleUpgrades(ctx, cancel, listeners)
 
 	// The app exits only once the root context is canceled.
 	<-ctx.Done()
@@ -69,17 +118,69 @@ func main() {
 	cleanup(httpServer, handler)
 }
 
-// makeHttpServer makes the http server and returns it without calling any Listen methods.
-func makeHttpServer(ctx context.Context, addr string, handler http.Handler) *http.Server {
+// handleUpgrades hands the listeners over to a new copy of the binary upon every SIGUSR2.
+// Once the new process is ready, it cancels the root context so this process drains and exits as usual.
+func handleUpgrades(ctx context.Context, cancel context.CancelFunc, listeners []*upgrade.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		slog.InfoContext(ctx, "upgrade requested, starting the new process")
+		if err := upgrade.Start(ctx, listeners); err != nil {
+			// Keep serving. The upgrade can be retried with another signal.
+			slog.ErrorContext(ctx, "upgrade failed", "error", err)
+			continue
+		}
+
+		slog.InfoContext(ctx, "new process is ready, shutting down")
+		cancel()
+		return
+	}
+}
+
+// runDevCert implements the "dev-cert" subcommand. It generates a local CA and a server certificate for localhost that
+// can be used with the -dev-tls flag.
+//
+// The certificates are always written to devcert.DefaultDir, which is where the -dev-tls flag looks for them.
+func runDevCert(args []string) {
+	flags := flag.NewFlagSet("dev-cert", flag.ExitOnError)
+	_ = flags.Parse(args) // ExitOnError makes the error check redundant.
+
+	if err := devcert.Generate(devcert.DefaultDir); err != nil {
+		panic("failed to generate development certificates: " + err.Error())
+	}
+
+	fmt.Printf("Development certificates written to %s\n", devcert.DefaultDir)
+	caCertPath := devcert.CACertPath(devcert.DefaultDir)
+	fmt.Printf("Add %s to your trust store, then start the server with -dev-tls.\n", caCertPath)
+}
+
+// makeHttpServer makes the http server and returns it without calling any Serve methods.
+func makeHttpServer(ctx context.Context, conf config.Config, handler http.Handler) *http.Server {
+	// HTTP/2 over TLS is served whenever TLS is in use. Cleartext HTTP/2 (h2c) is opt-in.
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(conf.HttpServer.H2C)
+
 	return &http.Server{
 		BaseContext:       func(_ net.Listener) context.Context { return ctx },
-		Addr:              addr,
-		ReadHeaderTimeout: time.Second * 5,
-		ReadTimeout:       0, // Not set to avoid problems with websocket connections.
-		WriteTimeout:      0, // Not set to avoid problems with websocket connections.
-		IdleTimeout:       time.Second * 60,
-		MaxHeaderBytes:    64 * 1024, // 64 KB
-		Handler:           handler,
+		Protocols:         protocols,
+		ReadHeaderTimeout: time.Second * time.Duration(conf.HttpServer.ReadHeaderTimeoutSec),
+		// Not set to avoid problems with websocket connections.
+		// Read and write deadlines are applied per route by the handler instead.
+		ReadTimeout:    0,
+		WriteTimeout:   0,
+		IdleTimeout:    time.Second * time.Duration(conf.HttpServer.IdleTimeoutSec),
+		MaxHeaderBytes: conf.HttpServer.MaxHeaderBytes,
+		Handler:        handler,
 	}
 }
 
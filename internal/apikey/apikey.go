@@ -0,0 +1,98 @@
+// Package apikey implements API key authentication with hashed key storage.
+//
+// Keys are never stored in plain text. A store only holds the SHA-256 hashes of the keys, so a leaked store does not
+// leak usable keys. Since API keys are long random strings, unlike passwords, a plain SHA-256 hash is sufficient.
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when no key matches the hash.
+var ErrNotFound = errors.New("api key not found")
+
+// Key is a stored API key.
+type Key struct {
+	// ID identifies the key in logs. It is not a secret.
+	ID string `json:"id"`
+	// Hash is the hex-encoded SHA-256 hash of the key.
+	Hash string `json:"hash"`
+	// Roles and scopes granted to the key.
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is the time after which the key is rejected. Zero means it never expires.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired reports whether the key is expired at the given time.
+func (k *Key) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// Store looks up API keys by their hashes. Implementations must be safe for concurrent use.
+type Store interface {
+	// Lookup returns the key with the given hash, or ErrNotFound.
+	Lookup(ctx context.Context, hash string) (*Key, error)
+}
+
+// Hash returns the hex-encoded SHA-256 hash of the given key, as kept by a Store.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// FileStore is a Store backed by a JSON file holding an array of keys. The file is read once, upon creation.
+type FileStore struct {
+	keys map[string]*Key
+}
+
+// LoadFileStore reads the keys from the given JSON file.
+func LoadFileStore(path string) (*FileStore, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys file at %s because: %w", path, err)
+	}
+
+	var keys []*Key
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api keys file at %s because: %w", path, err)
+	}
+
+	store := &FileStore{keys: make(map[string]*Key, len(keys))}
+	ids := make(map[string]struct{}, len(keys))
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("api key id is required")
+		}
+		if _, exists := ids[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate api key id: %s", key.ID)
+		}
+		if decoded, err := hex.DecodeString(key.Hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("api key %s must have a hex-encoded SHA-256 hash", key.ID)
+		}
+
+		ids[key.ID] = struct{}{}
+		key.Hash = strings.ToLower(key.Hash)
+		store.keys[key.Hash] = key
+	}
+
+	return store, nil
+}
+
+// Lookup implements Store.
+func (f *FileStore) Lookup(_ context.Context, hash string) (*Key, error) {
+	key, exists := f.keys[hash]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
@@ -0,0 +1,64 @@
+package apikey
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileStore(t *testing.T) {
+	hash := Hash("secret-key")
+
+	testCases := []struct {
+		name          string
+		content       string
+		errorContains string
+	}{
+		{
+			name:    "Valid",
+			content: `[{"id": "billing", "hash": "` + strings.ToUpper(hash) + `", "scopes": ["invoices:read"]}]`,
+		},
+		{name: "Missing ID", content: `[{"hash": "` + hash + `"}]`, errorContains: "id is required"},
+		{
+			name:          "Duplicate ID",
+			content:       `[{"id": "a", "hash": "` + hash + `"}, {"id": "a", "hash": "` + Hash("other") + `"}]`,
+			errorContains: "duplicate",
+		},
+		{name: "Plain key", content: `[{"id": "a", "hash": "secret-key"}]`, errorContains: "SHA-256"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+
+			store, err := LoadFileStore(path)
+			if tc.errorContains != "" {
+				require.ErrorContains(t, err, tc.errorContains)
+				return
+			}
+			require.NoError(t, err)
+
+			// Upper-case hashes in the file still match.
+			key, err := store.Lookup(context.Background(), hash)
+			require.NoError(t, err)
+			require.Equal(t, "billing", key.ID)
+			require.Equal(t, []string{"invoices:read"}, key.Scopes)
+
+			_, err = store.Lookup(context.Background(), Hash("wrong-key"))
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestKey_Expired(t *testing.T) {
+	now := time.Now()
+	require.False(t, (&Key{}).Expired(now))
+	require.False(t, (&Key{ExpiresAt: now.Add(time.Minute)}).Expired(now))
+	require.True(t, (&Key{ExpiresAt: now.Add(-time.Minute)}).Expired(now))
+}
@@ -4,23 +4,173 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 )
 
 // Config encapsulates all config required by the application.
 type Config struct {
 	HttpServer struct {
-		Addr           string   `json:"addr"`
+		// Addresses to listen on, like "tcp://:8080", "unix:///run/squelette.sock" or "systemd://".
+		// See the listener package for the supported formats.
+		Listen []string `json:"listen"`
+		// Deprecated: Use Listen instead. A TCP address like ":8080", which is served as if it was listed in Listen.
+		Addr string `json:"addr"`
+		// Octal permissions for Unix domain socket files, like "0660". Optional.
+		UnixSocketPerm string `json:"unixSocketPerm"`
+		// Serve HTTP/2 without TLS (h2c), using prior knowledge or "Upgrade: h2c", along with HTTP/1.1.
+		H2C bool `json:"h2c"`
+
+		// Server-wide limits. See http.Server for details. They default to 5 seconds, 60 seconds and 64 KB.
+		ReadHeaderTimeoutSec int `json:"readHeaderTimeoutSec"`
+		IdleTimeoutSec       int `json:"idleTimeoutSec"`
+		MaxHeaderBytes       int `json:"maxHeaderBytes"`
+		// Default read and write deadlines for routes. Routes can override them, and streaming routes are exempt.
+		// Zero means no deadline.
+		RouteReadTimeoutSec  int `json:"routeReadTimeoutSec"`
+		RouteWriteTimeoutSec int `json:"routeWriteTimeoutSec"`
+		// Default deadline of the request context. It must be shorter than the route write timeout, so the timeout
+		// response can still be written. Routes can override it, and streaming routes are exempt. Zero means no
+		// deadline.
+		RequestTimeoutSec int `json:"requestTimeoutSec"`
+
 		AllowedOrigins []string `json:"allowedOrigins"`
 		// Read here: https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Access-Control-Max-Age
 		CorsMaxAgeSec int `json:"corsMaxAgeSec"`
+
+		// RFC 9457 problem details for error responses. They are always written to the clients that ask for them.
+		ProblemDetails struct {
+			// Write problem details to all clients, instead of the {status, reason} shape.
+			Always bool `json:"always"`
+			// Prefixed to error codes to make the "type" member, like "https://example.com/problems/". Optional.
+			TypeBaseURI string `json:"typeBaseUri"`
+		} `json:"problemDetails"`
+
+		// Locales that the messages of registered error codes are translated to, like "fr" or "pt-BR". Clients get the
+		// messages in the language of their Accept-Language header. Checked at startup. Optional.
+		Locales []string `json:"locales"`
+
+		// Compress response bodies with gzip, zstd or brotli, as accepted by the client.
+		Compression struct {
+			Enabled bool `json:"enabled"`
+			// Bodies smaller than this are sent uncompressed, since compression would not save much.
+			MinSizeBytes int `json:"minSizeBytes"`
+		} `json:"compression"`
 	} `json:"httpServer"`
 
+	RateLimit struct {
+		// Max number of clients tracked by the in-memory store. The least recently seen ones are evicted first.
+		MaxKeys int `json:"maxKeys"`
+		// Use the last X-Forwarded-For address as the client IP. Enable only behind a trusted reverse proxy.
+		TrustForwardedFor bool `json:"trustForwardedFor"`
+		// Limits per route group. Routes belong to the "default" group unless they specify another.
+		// Routes of a group that is absent here are not limited.
+		Groups map[string]RateLimitGroup `json:"groups"`
+	} `json:"rateLimit"`
+
+	LoadShedding struct {
+		// Either "fixed" or "adaptive". Empty disables load shedding.
+		Mode string `json:"mode"`
+		// The fixed limit on requests in flight, or the upper bound of the adaptive limit.
+		MaxInFlight int `json:"maxInFlight"`
+		// The lower bound of the adaptive limit. Only for the adaptive mode.
+		MinInFlight int `json:"minInFlight"`
+		// Latency above which the adaptive limit is reduced. Only for the adaptive mode.
+		LatencyTargetMs int `json:"latencyTargetMs"`
+		// Max number of requests waiting for a slot, and how long they may wait before being shed.
+		MaxQueue       int `json:"maxQueue"`
+		QueueTimeoutMs int `json:"queueTimeoutMs"`
+		// Value of the Retry-After header sent with shed requests.
+		RetryAfterSec int `json:"retryAfterSec"`
+	} `json:"loadShedding"`
+
+	Idempotency struct {
+		// How long the responses of requests with an Idempotency-Key are kept for replay. Defaults to a day.
+		TTLSec int `json:"ttlSec"`
+	} `json:"idempotency"`
+
+	SSE struct {
+		// How often a comment is sent on event streams, so that proxies do not close them as idle. Defaults to 15.
+		HeartbeatSec int `json:"heartbeatSec"`
+		// How long clients wait before reconnecting when their stream is lost. Zero leaves it to the clients.
+		RetryMs int `json:"retryMs"`
+		// Number of recent events kept per topic, for clients that reconnect with a Last-Event-ID. Zero disables replay.
+		ReplaySize int `json:"replaySize"`
+		// How long the events of a topic without subscribers are kept after the last one is published. Defaults to
+		// 10 minutes.
+		ReplayTTLSec int `json:"replayTtlSec"`
+	} `json:"sse"`
+
+	WebSocket struct {
+		// Max size of a received message. Larger messages close the connection. Defaults to 64 KB.
+		MaxMessageBytes int64 `json:"maxMessageBytes"`
+		// How often connections are pinged, and how long they may stay silent after that before they are dropped.
+		// They default to 30 and 10 seconds.
+		PingIntervalSec int `json:"pingIntervalSec"`
+		PongTimeoutSec  int `json:"pongTimeoutSec"`
+		// Max duration of a write to a connection. Defaults to 10 seconds.
+		WriteTimeoutSec int `json:"writeTimeoutSec"`
+	} `json:"websocket"`
+
+	Auth struct {
+		// Bearer token authentication. It is enabled if any keys or a JWKS are configured.
+		JWT struct {
+			// Expected "iss" and "aud" claims. Optional.
+			Issuer   string `json:"issuer"`
+			Audience string `json:"audience"`
+			// Tolerated clock skew when checking token expiry.
+			LeewaySec int `json:"leewaySec"`
+			// Verification keys known in advance.
+			Keys []JWTKey `json:"keys"`
+			// URL or file path of a JSON Web Key Set, and how often it is refreshed.
+			JWKS           string `json:"jwks"`
+			JWKSRefreshSec int    `json:"jwksRefreshSec"`
+		} `json:"jwt"`
+
+		// API key authentication, through the X-API-Key header.
+		APIKeys struct {
+			// Path of the JSON file with the hashed API keys. Empty disables API key authentication.
+			File string `json:"file"`
+		} `json:"apiKeys"`
+
+		// Signed webhooks from partners, by name. Routes refer to them by name.
+		Webhooks map[string]Webhook `json:"webhooks"`
+	} `json:"auth"`
+
 	Logger struct {
 		Level  string `json:"level"`
 		Pretty bool   `json:"pretty"`
 	} `json:"logger"`
 }
 
+// RateLimitGroup is the token bucket configuration of a route group.
+type RateLimitGroup struct {
+	// Sustained rate of requests allowed per client.
+	RequestsPerSec float64 `json:"requestsPerSec"`
+	// Max number of requests allowed per client at once.
+	Burst int `json:"burst"`
+}
+
+// Webhook is the signature configuration of a partner's webhooks.
+type Webhook struct {
+	// Signing secrets. Requests signed with any of them are accepted, so they can be rotated by adding the new one
+	// before the partner switches, and removing the old one after.
+	Secrets []string `json:"secrets"`
+	// How far the request timestamp may be from the current time.
+	ToleranceSec int `json:"toleranceSec"`
+}
+
+// JWTKey is a token verification key.
+type JWTKey struct {
+	// Key ID, matched against the "kid" header of tokens. May be empty if there is a single key for the algorithm.
+	ID string `json:"kid"`
+	// One of "HS256", "RS256" and "ES256".
+	Algorithm string `json:"alg"`
+	// The shared secret, for HS256.
+	Secret string `json:"secret"`
+	// Path of the PEM-encoded public key, for RS256 and ES256.
+	PublicKeyFile string `json:"publicKeyFile"`
+}
+
 // Load config from the given JSON file.
 func Load(jsonPath string) (Config, error) {
 	content, err := os.ReadFile(jsonPath)
@@ -33,6 +183,12 @@ func Load(jsonPath string) (Config, error) {
 		return Config{}, fmt.Errorf("failed to unmarshal config file at %s because: %w", jsonPath, err)
 	}
 
+	// Configs written before Listen was introduced keep working.
+	if config.HttpServer.Addr != "" && len(config.HttpServer.Listen) == 0 {
+		config.HttpServer.Listen = []string{"tcp://" + config.HttpServer.Addr}
+	}
+	setDefaults(&config)
+
 	if err := validate(config); err != nil {
 		return Config{}, fmt.Errorf("config is invalid: %w", err)
 	}
@@ -40,10 +196,40 @@ func Load(jsonPath string) (Config, error) {
 	return config, nil
 }
 
+// setDefaults fills in the settings that are absent from the config, so that configs written before they were
+// introduced keep working. The server-wide limits default to the values that used to be hard-coded.
+func setDefaults(conf *Config) {
+	// Convenience function to default a single setting.
+	orDefault := func(value *int, fallback int) {
+		if *value == 0 {
+			*value = fallback
+		}
+	}
+
+	orDefault(&conf.HttpServer.ReadHeaderTimeoutSec, 5)
+	orDefault(&conf.HttpServer.IdleTimeoutSec, 60)
+	orDefault(&conf.HttpServer.MaxHeaderBytes, 64*1024)
+
+	orDefault(&conf.Idempotency.TTLSec, 24*60*60)
+
+	orDefault(&conf.SSE.HeartbeatSec, 15)
+	orDefault(&conf.SSE.ReplayTTLSec, 10*60)
+
+	if conf.WebSocket.MaxMessageBytes == 0 {
+		conf.WebSocket.MaxMessageBytes = 64 * 1024
+	}
+	orDefault(&conf.WebSocket.PingIntervalSec, 30)
+	orDefault(&conf.WebSocket.PongTimeoutSec, 10)
+	orDefault(&conf.WebSocket.WriteTimeoutSec, 10)
+}
+
 // validate the loaded config.
 func validate(conf Config) error {
-	if conf.HttpServer.Addr == "" {
-		return fmt.Errorf("http server address is required")
+	if len(conf.HttpServer.Listen) == 0 {
+		return fmt.Errorf("http server listen addresses are required")
+	}
+	if conf.HttpServer.Addr != "" && !slices.Contains(conf.HttpServer.Listen, "tcp://"+conf.HttpServer.Addr) {
+		return fmt.Errorf("http server addr is deprecated and cannot be used along with listen")
 	}
 	if len(conf.HttpServer.AllowedOrigins) == 0 {
 		return fmt.Errorf("http server allowed origins are required")
@@ -51,6 +237,118 @@ func validate(conf Config) error {
 	if conf.HttpServer.CorsMaxAgeSec == 0 {
 		return fmt.Errorf("http server cors max age is required")
 	}
+	if conf.HttpServer.ReadHeaderTimeoutSec <= 0 {
+		return fmt.Errorf("http server read header timeout must be positive")
+	}
+	if conf.HttpServer.IdleTimeoutSec <= 0 {
+		return fmt.Errorf("http server idle timeout must be positive")
+	}
+	if conf.HttpServer.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("http server max header bytes must be positive")
+	}
+	if conf.HttpServer.RouteReadTimeoutSec < 0 || conf.HttpServer.RouteWriteTimeoutSec < 0 {
+		return fmt.Errorf("http server route read and write timeouts must not be negative")
+	}
+	if conf.HttpServer.RequestTimeoutSec < 0 {
+		return fmt.Errorf("http server request timeout must not be negative")
+	}
+	if conf.HttpServer.RequestTimeoutSec > 0 && conf.HttpServer.RouteWriteTimeoutSec > 0 &&
+		conf.HttpServer.RequestTimeoutSec >= conf.HttpServer.RouteWriteTimeoutSec {
+		return fmt.Errorf("http server request timeout must be shorter than the route write timeout")
+	}
+
+	if slices.Contains(conf.HttpServer.Locales, "") {
+		return fmt.Errorf("http server locales must not be empty")
+	}
+
+	if conf.HttpServer.Compression.MinSizeBytes < 0 {
+		return fmt.Errorf("http server compression min size must not be negative")
+	}
+
+	if len(conf.RateLimit.Groups) > 0 && conf.RateLimit.MaxKeys <= 0 {
+		return fmt.Errorf("rate limit max keys must be positive")
+	}
+	for name, group := range conf.RateLimit.Groups {
+		if group.RequestsPerSec <= 0 || group.Burst <= 0 {
+			return fmt.Errorf("rate limit group %q must have a positive rate and burst", name)
+		}
+	}
+
+	switch conf.LoadShedding.Mode {
+	case "":
+	case "fixed", "adaptive":
+		if conf.LoadShedding.MaxInFlight <= 0 {
+			return fmt.Errorf("load shedding max in-flight must be positive")
+		}
+		if conf.LoadShedding.MaxQueue < 0 || conf.LoadShedding.QueueTimeoutMs < 0 {
+			return fmt.Errorf("load shedding queue settings must not be negative")
+		}
+		if conf.LoadShedding.RetryAfterSec <= 0 {
+			return fmt.Errorf("load shedding retry after must be positive")
+		}
+		if conf.LoadShedding.Mode == "fixed" {
+			break
+		}
+		if conf.LoadShedding.MinInFlight <= 0 || conf.LoadShedding.MinInFlight > conf.LoadShedding.MaxInFlight {
+			return fmt.Errorf("load shedding min in-flight must be positive and not above max in-flight")
+		}
+		if conf.LoadShedding.LatencyTargetMs <= 0 {
+			return fmt.Errorf("load shedding latency target must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown load shedding mode: %s", conf.LoadShedding.Mode)
+	}
+
+	if conf.Idempotency.TTLSec <= 0 {
+		return fmt.Errorf("idempotency ttl must be positive")
+	}
+
+	if conf.SSE.HeartbeatSec <= 0 {
+		return fmt.Errorf("sse heartbeat interval must be positive")
+	}
+	if conf.SSE.RetryMs < 0 || conf.SSE.ReplaySize < 0 {
+		return fmt.Errorf("sse retry and replay size must not be negative")
+	}
+	if conf.SSE.ReplayTTLSec <= 0 {
+		return fmt.Errorf("sse replay ttl must be positive")
+	}
+
+	if conf.WebSocket.MaxMessageBytes <= 0 {
+		return fmt.Errorf("websocket max message size must be positive")
+	}
+	if conf.WebSocket.PingIntervalSec <= 0 || conf.WebSocket.PongTimeoutSec <= 0 {
+		return fmt.Errorf("websocket ping interval and pong timeout must be positive")
+	}
+	if conf.WebSocket.WriteTimeoutSec <= 0 {
+		return fmt.Errorf("websocket write timeout must be positive")
+	}
+
+	for _, key := range conf.Auth.JWT.Keys {
+		switch key.Algorithm {
+		case "HS256":
+			if len(key.Secret) < 32 {
+				return fmt.Errorf("jwt key %q must have a secret of at least 32 bytes", key.ID)
+			}
+		case "RS256", "ES256":
+			if key.PublicKeyFile == "" {
+				return fmt.Errorf("jwt key %q must have a public key file", key.ID)
+			}
+		default:
+			return fmt.Errorf("jwt key %q has unsupported algorithm: %s", key.ID, key.Algorithm)
+		}
+	}
+	if conf.Auth.JWT.JWKS != "" && conf.Auth.JWT.JWKSRefreshSec <= 0 {
+		return fmt.Errorf("jwks refresh interval must be positive")
+	}
+
+	for name, webhook := range conf.Auth.Webhooks {
+		if len(webhook.Secrets) == 0 || slices.Contains(webhook.Secrets, "") {
+			return fmt.Errorf("webhook %q must have non-empty secrets", name)
+		}
+		if webhook.ToleranceSec <= 0 {
+			return fmt.Errorf("webhook %q tolerance must be positive", name)
+		}
+	}
 
 	if conf.Logger.Level == "" {
 		return fmt.Errorf("logger level is required")
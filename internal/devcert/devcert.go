@@ -0,0 +1,159 @@
+// Package devcert generates a self-signed certificate authority and a server certificate for local development.
+//
+// The generated certificates are valid for "localhost", 127.0.0.1 and ::1 only. They must never be used in production.
+//
+// The CA is name-constrained to the loopback names and addresses, and its key is discarded once the server certificate
+// is signed, so trusting the CA does not allow anyone to impersonate other hosts.
+package devcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultDir is the directory where the certificates are generated and looked up by default.
+	DefaultDir = "config/dev-cert"
+
+	// File names of the generated artifacts.
+	caCertFile = "ca.pem"
+	certFile   = "cert.pem"
+	keyFile    = "key.pem"
+	// The CA key used to be written too. It is removed if present, since the new CA replaces the old one.
+	legacyCAKeyFile = "ca-key.pem"
+
+	// Browsers reject server certificates with very long validity periods, so the server certificate is kept short.
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+)
+
+// CACertPath returns the path of the CA certificate inside the given directory.
+// This is the file that developers add to their trust store.
+func CACertPath(dir string) string { return filepath.Join(dir, caCertFile) }
+
+// CertPath returns the path of the server certificate inside the given directory.
+func CertPath(dir string) string { return filepath.Join(dir, certFile) }
+
+// KeyPath returns the path of the server private key inside the given directory.
+func KeyPath(dir string) string { return filepath.Join(dir, keyFile) }
+
+// Generate creates a new local CA and a server certificate signed by it, and writes them into the given directory.
+// Existing files are overwritten. The CA key is never written, so a new CA is created every time.
+func Generate(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create directory %s because: %w", dir, err)
+	}
+
+	now := time.Now()
+
+	// Certificate authority.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"squelette development CA"}, CommonName: "squelette dev CA"},
+		NotBefore:             now.Add(-time.Hour), // Tolerate small clock skews.
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// Clients that honor the constraints reject any other name signed by the CA.
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"localhost"},
+		PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	// Server certificate.
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %w", err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"squelette development"}, CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %w", err)
+	}
+
+	// Persist everything but the CA key.
+	if err := writePEM(CACertPath(dir), "CERTIFICATE", caDER, 0o644); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, legacyCAKeyFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the old CA key because: %w", err)
+	}
+	if err := writePEM(CertPath(dir), "CERTIFICATE", serverDER, 0o644); err != nil {
+		return err
+	}
+	if err := writeKey(KeyPath(dir), serverKey); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeKey writes the given private key as a PKCS #8 PEM file readable only by the owner.
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key for %s: %w", path, err)
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0o600)
+}
+
+// writePEM encodes the given DER bytes as a PEM block and writes them to the given path.
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, content, perm); err != nil {
+		return fmt.Errorf("failed to write %s because: %w", path, err)
+	}
+	return nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number.
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		// crypto/rand failures are not recoverable.
+		panic("failed to generate certificate serial: " + err.Error())
+	}
+	return serial
+}
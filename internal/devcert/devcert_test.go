@@ -0,0 +1,70 @@
+package devcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dev-cert")
+
+	// The CA key of an older run is removed.
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, legacyCAKeyFile), []byte("key"), 0o600))
+
+	require.NoError(t, Generate(dir))
+
+	// Only the public files can be read by others, and the CA key is not written.
+	expectedPerms := map[string]os.FileMode{caCertFile: 0o644, certFile: 0o644, keyFile: 0o600}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, len(expectedPerms))
+	for name, perm := range expectedPerms {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, perm, info.Mode().Perm(), name)
+	}
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+
+	// The CA is constrained to the loopback names and addresses.
+	caCert := readCert(t, CACertPath(dir))
+	require.True(t, caCert.PermittedDNSDomainsCritical)
+	require.Equal(t, []string{"localhost"}, caCert.PermittedDNSDomains)
+	require.Len(t, caCert.PermittedIPRanges, 2)
+
+	// The server certificate is valid for the loopback names and addresses, and matches its key.
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	serverCert := readCert(t, CertPath(dir))
+	for _, name := range []string{"localhost", "127.0.0.1", "::1"} {
+		_, err := serverCert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		require.NoError(t, err, name)
+	}
+	_, err = serverCert.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	require.Error(t, err)
+
+	_, err = tls.LoadX509KeyPair(CertPath(dir), KeyPath(dir))
+	require.NoError(t, err)
+}
+
+// readCert parses the PEM-encoded certificate at the given path.
+func readCert(t *testing.T, path string) *x509.Certificate {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(content)
+	require.NotNil(t, block)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
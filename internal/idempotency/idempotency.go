@@ -0,0 +1,119 @@
+// Package idempotency stores the responses of requests made with an Idempotency-Key, so that retries of the same
+// request get the same response instead of repeating its side effects.
+//
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInProgress is returned when a request with the same key has started but not completed yet.
+	ErrInProgress = errors.New("a request with the same idempotency key is in progress")
+	// ErrMismatch is returned when the key was used before for a different request.
+	ErrMismatch = errors.New("the idempotency key was used for a different request")
+)
+
+// Response is a stored response.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Store keeps the responses of requests by their idempotency keys. Implementations must be safe for concurrent use.
+type Store interface {
+	// Start reserves the key for a request with the given fingerprint.
+	//
+	// It returns the stored response if the same request has already completed, ErrInProgress if it is still in
+	// progress, and ErrMismatch if the key was used for a request with a different fingerprint. Otherwise, it returns
+	// nil, and the caller must either Complete or Abandon the key.
+	Start(ctx context.Context, key, fingerprint string) (*Response, error)
+	// Complete stores the response under the key.
+	Complete(ctx context.Context, key string, response *Response) error
+	// Abandon releases the key without storing a response, so that the request can be retried.
+	Abandon(ctx context.Context, key string) error
+}
+
+// entry is a key in a MemoryStore.
+type entry struct {
+	fingerprint string
+	// Nil while the request is in progress.
+	response  *Response
+	expiresAt time.Time
+}
+
+// sweepInterval is how often expired keys are removed from a MemoryStore.
+const sweepInterval = time.Minute
+
+// MemoryStore is an in-memory Store. Keys expire after a fixed TTL, whether they are completed or not.
+type MemoryStore struct {
+	ttl time.Duration
+
+	mutex     sync.Mutex
+	entries   map[string]*entry
+	nextSweep time.Time
+
+	// Controllable clock for tests.
+	now func() time.Time
+}
+
+// NewMemoryStore returns a new MemoryStore that keeps keys for the given duration.
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, entries: map[string]*entry{}, now: time.Now}
+}
+
+// Start implements Store.
+func (m *MemoryStore) Start(_ context.Context, key, fingerprint string) (*Response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	if now.After(m.nextSweep) {
+		for k, e := range m.entries {
+			if now.After(e.expiresAt) {
+				delete(m.entries, k)
+			}
+		}
+		m.nextSweep = now.Add(sweepInterval)
+	}
+
+	if e, exists := m.entries[key]; exists && !now.After(e.expiresAt) {
+		switch {
+		case e.fingerprint != fingerprint:
+			return nil, ErrMismatch
+		case e.response == nil:
+			return nil, ErrInProgress
+		default:
+			return e.response, nil
+		}
+	}
+
+	m.entries[key] = &entry{fingerprint: fingerprint, expiresAt: now.Add(m.ttl)}
+	return nil, nil
+}
+
+// Complete implements Store.
+func (m *MemoryStore) Complete(_ context.Context, key string, response *Response) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if e, exists := m.entries[key]; exists {
+		e.response = response
+	}
+	return nil
+}
+
+// Abandon implements Store.
+func (m *MemoryStore) Abandon(_ context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
@@ -0,0 +1,53 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	store := NewMemoryStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	// The first request reserves the key.
+	response, err := store.Start(ctx, "key", "fingerprint")
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	// Retries are rejected while it is in progress, and different requests always.
+	_, err = store.Start(ctx, "key", "fingerprint")
+	require.ErrorIs(t, err, ErrInProgress)
+	_, err = store.Start(ctx, "key", "other")
+	require.ErrorIs(t, err, ErrMismatch)
+
+	// Retries get the stored response once it completes.
+	stored := &Response{StatusCode: http.StatusCreated, Header: http.Header{}, Body: []byte("created")}
+	require.NoError(t, store.Complete(ctx, "key", stored))
+
+	response, err = store.Start(ctx, "key", "fingerprint")
+	require.NoError(t, err)
+	require.Equal(t, stored, response)
+
+	// Abandoned keys can be reused.
+	_, err = store.Start(ctx, "abandoned", "fingerprint")
+	require.NoError(t, err)
+	require.NoError(t, store.Abandon(ctx, "abandoned"))
+
+	response, err = store.Start(ctx, "abandoned", "fingerprint")
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	// Keys expire after the TTL.
+	now = now.Add(2 * time.Hour)
+	response, err = store.Start(ctx, "key", "other")
+	require.NoError(t, err)
+	require.Nil(t, response)
+	require.Len(t, store.entries, 1)
+}
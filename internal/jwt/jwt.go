@@ -0,0 +1,238 @@
+// Package jwt verifies JSON Web Tokens (RFC 7519) signed with HS256, RS256 or ES256.
+//
+// Only verification is supported. Tokens are issued by an external identity provider.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// ErrInvalidToken is wrapped by all errors caused by a malformed, unverifiable or unacceptable token.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the verified claims of a token.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+
+	// Raw holds all the claims, including the registered ones above.
+	Raw map[string]any
+}
+
+// Options configure a Verifier.
+type Options struct {
+	// Issuer, if not empty, must match the "iss" claim.
+	Issuer string
+	// Audience, if not empty, must be present in the "aud" claim.
+	Audience string
+	// Leeway tolerates clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// Verifier verifies tokens against a KeySet. It is safe for concurrent use.
+type Verifier struct {
+	keys KeySet
+	opts Options
+	// now is replaceable for testing.
+	now func() time.Time
+}
+
+// NewVerifier returns a new Verifier.
+func NewVerifier(keys KeySet, opts Options) *Verifier {
+	return &Verifier{keys: keys, opts: opts, now: time.Now}
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verify checks the signature and the registered claims of the given compact-serialized token, and returns its claims.
+//
+// A token without an "exp" claim is rejected.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %w", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %w", ErrInvalidToken, err)
+	}
+
+	// Unsupported algorithms, including "none", are rejected before any key lookup.
+	if !slices.Contains([]string{HS256, RS256, ES256}, hdr.Alg) {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, hdr.Alg)
+	}
+
+	key, err := v.keys.Key(ctx, hdr.Kid, hdr.Alg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if err := verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %w", ErrInvalidToken, err)
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return claims, nil
+}
+
+// validate checks the registered claims.
+func (v *Verifier) validate(claims *Claims) error {
+	now := v.now()
+
+	if claims.ExpiresAt.IsZero() {
+		return errors.New("token has no expiry")
+	}
+	if now.After(claims.ExpiresAt.Add(v.opts.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.opts.Leeway).Before(claims.NotBefore) {
+		return errors.New("token is not valid yet")
+	}
+	if v.opts.Issuer != "" && claims.Issuer != v.opts.Issuer {
+		return errors.New("unexpected issuer")
+	}
+	if v.opts.Audience != "" && !slices.Contains(claims.Audience, v.opts.Audience) {
+		return errors.New("unexpected audience")
+	}
+
+	return nil
+}
+
+// verifySignature checks the signature of the signing input with the given key.
+//
+// The key type must match the algorithm. This prevents algorithm confusion attacks, like using an RSA public key as
+// an HMAC secret.
+func verifySignature(alg string, key any, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not an HMAC secret")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("signature mismatch")
+		}
+
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA public key")
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("signature mismatch")
+		}
+
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve.Params().Name != "P-256" {
+			return errors.New("key is not a P-256 public key")
+		}
+		// The signature is the concatenation of R and S, 32 bytes each.
+		if len(signature) != 64 {
+			return errors.New("signature mismatch")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errors.New("signature mismatch")
+		}
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	return nil
+}
+
+// parseClaims decodes the claims segment of a token.
+func parseClaims(segment string) (*Claims, error) {
+	raw := map[string]any{}
+	if err := decodeSegment(segment, &raw); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{Raw: raw}
+	claims.Subject, _ = raw["sub"].(string)
+	claims.Issuer, _ = raw["iss"].(string)
+
+	// The audience may be a single string or an array of strings.
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []any:
+		for _, entry := range aud {
+			if s, ok := entry.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+
+	claims.ExpiresAt = numericDate(raw["exp"])
+	claims.NotBefore = numericDate(raw["nbf"])
+	claims.IssuedAt = numericDate(raw["iat"])
+	return claims, nil
+}
+
+// numericDate converts a NumericDate claim (seconds since the epoch) to time.Time. Absent values become zero.
+func numericDate(value any) time.Time {
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token into the given target.
+func decodeSegment(segment string, target any) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, target)
+}
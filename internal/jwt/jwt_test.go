@@ -0,0 +1,267 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// signToken creates a compact-serialized token with the given header and claims, signed with the given private key.
+func signToken(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(map[string]any{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	claimsJSON, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case RS256:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwksStub is a local JWKS endpoint whose keys can be rotated during a test.
+type jwksStub struct {
+	mu       sync.Mutex
+	keys     []map[string]any
+	requests int
+}
+
+func (j *jwksStub) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.requests++
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": j.keys})
+}
+
+func (j *jwksStub) setKeys(keys ...map[string]any) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+}
+
+func (j *jwksStub) requestCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.requests
+}
+
+// rsaJWK converts an RSA public key to a JWK.
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]any {
+	return map[string]any{
+		"kty": "RSA", "kid": kid, "alg": RS256, "use": "sig",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// ecJWK converts a P-256 public key to a JWK.
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]any {
+	point, _ := key.Bytes()
+	return map[string]any{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(point[1:33]),
+		"y": base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+}
+
+func TestVerifier_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Initially, only the RSA key is published.
+	stub := &jwksStub{}
+	stub.setKeys(rsaJWK("rsa-1", &rsaKey.PublicKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	// Controllable clock.
+	now := time.Now()
+	jwks := NewJWKS(server.URL, time.Hour)
+	jwks.now = func() time.Time { return now }
+
+	verifier := NewVerifier(jwks, Options{Issuer: "issuer", Audience: "squelette"})
+	verifier.now = func() time.Time { return now }
+
+	claims := map[string]any{
+		"sub": "user-1", "iss": "issuer", "aud": []string{"squelette", "other"},
+		"exp": now.Add(time.Minute).Unix(), "scope": "read",
+	}
+
+	// A token signed by the published key is accepted.
+	verified, err := verifier.Verify(context.Background(), signToken(t, RS256, "rsa-1", claims, rsaKey))
+	require.NoError(t, err)
+	require.Equal(t, "user-1", verified.Subject)
+	require.Equal(t, []string{"squelette", "other"}, verified.Audience)
+	require.Equal(t, "read", verified.Raw["scope"])
+	require.Equal(t, 1, stub.requestCount())
+
+	// The keys are cached.
+	_, err = verifier.Verify(context.Background(), signToken(t, RS256, "rsa-1", claims, rsaKey))
+	require.NoError(t, err)
+	require.Equal(t, 1, stub.requestCount())
+
+	// A new key is rotated in. Unknown key IDs trigger a refresh, but not too often.
+	stub.setKeys(rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey))
+	ecToken := signToken(t, ES256, "ec-1", claims, ecKey)
+
+	_, err = verifier.Verify(context.Background(), ecToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	require.Equal(t, 1, stub.requestCount())
+
+	now = now.Add(minRefreshInterval)
+	_, err = verifier.Verify(context.Background(), ecToken)
+	require.NoError(t, err)
+	require.Equal(t, 2, stub.requestCount())
+
+	// The RSA key is retired. Once the keys are stale, they are still served while they are refreshed in the
+	// background.
+	stub.setKeys(ecJWK("ec-1", &ecKey.PublicKey))
+	now = now.Add(time.Hour)
+	stale := jwks.snapshot.Load()
+
+	_, err = jwks.Key(context.Background(), "rsa-1", RS256)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return jwks.snapshot.Load() != stale }, time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, stub.requestCount())
+
+	// The retired key is gone, and it does not trigger another refresh right away.
+	_, err = jwks.Key(context.Background(), "rsa-1", RS256)
+	require.ErrorContains(t, err, `unknown key ID "rsa-1"`)
+	require.Equal(t, 3, stub.requestCount())
+}
+
+func TestParseJWKS_WeakRSAKey(t *testing.T) {
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	content, err := json.Marshal(map[string]any{"keys": []map[string]any{rsaJWK("weak", &weakKey.PublicKey)}})
+	require.NoError(t, err)
+
+	_, err = parseJWKS(content)
+	require.ErrorContains(t, err, "key of 1024 bits is smaller than 2048 bits")
+}
+
+func TestJWKS_ConcurrentRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	stub := &jwksStub{}
+	stub.setKeys(rsaJWK("rsa-1", &rsaKey.PublicKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	jwks := NewJWKS(server.URL, time.Hour)
+
+	// Concurrent requests on a cold cache share a single fetch.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.Key(context.Background(), "rsa-1", RS256)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, stub.requestCount())
+}
+
+func TestVerifier_Rejections(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	now := time.Now()
+	keys := StaticKeys{
+		{ID: "hs", Algorithm: HS256, Key: secret},
+		{ID: "rsa", Algorithm: RS256, Key: &rsaKey.PublicKey},
+	}
+	verifier := NewVerifier(keys, Options{Issuer: "issuer", Leeway: time.Second})
+	verifier.now = func() time.Time { return now }
+
+	valid := map[string]any{"sub": "user-1", "iss": "issuer", "exp": now.Add(time.Minute).Unix()}
+
+	// Sanity check.
+	_, err = verifier.Verify(context.Background(), signToken(t, HS256, "hs", valid, secret))
+	require.NoError(t, err)
+
+	// Copies the valid claims with the given changes.
+	with := func(changes map[string]any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	// Used to forge an HS256 token with the RSA public key as the secret.
+	publicKeyBytes := rsaKey.PublicKey.N.Bytes()
+
+	testCases := map[string]string{
+		"Malformed":          "not-a-token",
+		"Expired":            signToken(t, HS256, "hs", with(map[string]any{"exp": now.Add(-time.Minute).Unix()}), secret),
+		"No expiry":          signToken(t, HS256, "hs", with(map[string]any{"exp": nil}), secret),
+		"Not valid yet":      signToken(t, HS256, "hs", with(map[string]any{"nbf": now.Add(time.Minute).Unix()}), secret),
+		"Wrong issuer":       signToken(t, HS256, "hs", with(map[string]any{"iss": "other"}), secret),
+		"Wrong secret":       signToken(t, HS256, "hs", valid, []byte("another secret of at least 32 bytes")),
+		"Unknown key":        signToken(t, HS256, "unknown", valid, secret),
+		"Algorithm mismatch": signToken(t, HS256, "rsa", valid, publicKeyBytes),
+		"Alg none":           "eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyLTEifQ.",
+	}
+
+	for name, token := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(context.Background(), token)
+			require.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minRefreshInterval limits how often unknown key IDs can trigger a JWKS refresh, so tokens with made-up key IDs
+	// cannot be used to flood the identity provider.
+	minRefreshInterval = 30 * time.Second
+	// fetchTimeout bounds a single JWKS fetch.
+	fetchTimeout = 10 * time.Second
+	// maxJWKSBytes bounds the size of a JWKS document.
+	maxJWKSBytes = 1 << 20 // 1 MB
+	// minRSAKeyBits is the smallest RSA modulus accepted from a JWKS. Smaller keys can be factored.
+	minRSAKeyBits = 2048
+)
+
+// KeySet provides the keys that verify token signatures. Implementations must be safe for concurrent use.
+type KeySet interface {
+	// Key returns the key with the given ID for the given algorithm. The key ID may be empty if the token has none.
+	//
+	// The key must be a []byte for HS256, an *rsa.PublicKey for RS256 and an *ecdsa.PublicKey for ES256.
+	Key(ctx context.Context, kid, alg string) (any, error)
+}
+
+// StaticKey is a key known in advance, usually from the config.
+type StaticKey struct {
+	ID        string
+	Algorithm string
+	Key       any
+}
+
+// StaticKeys is a KeySet of keys known in advance.
+type StaticKeys []StaticKey
+
+// Key implements KeySet.
+func (s StaticKeys) Key(_ context.Context, kid, alg string) (any, error) {
+	candidates := make([]StaticKey, 0, len(s))
+	for _, key := range s {
+		if key.Algorithm == alg {
+			candidates = append(candidates, key)
+		}
+	}
+	return pickKey(candidates, kid)
+}
+
+// ParsePublicKeyPEM parses a PEM-encoded PKIX public key. It returns an *rsa.PublicKey or an *ecdsa.PublicKey.
+func ParsePublicKeyPEM(content []byte) (any, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// JWKS is a KeySet backed by a JSON Web Key Set (RFC 7517), fetched from a URL or read from a file.
+//
+// The keys are cached, and refreshed in the background once they are older than the refresh interval, so requests
+// are not held up by it. A token signed with an unknown key ID triggers an early refresh, so rotated keys are picked
+// up without waiting. If a refresh fails, the cached keys keep being used.
+type JWKS struct {
+	source          string
+	refreshInterval time.Duration
+	client          *http.Client
+	// now is replaceable for testing.
+	now func() time.Time
+
+	// The cached keys are read without locking, so requests are never held up by a refresh they do not need.
+	snapshot atomic.Pointer[jwksSnapshot]
+	// Guards the refresh in flight, so concurrent refreshes collapse into one.
+	mu       sync.Mutex
+	inflight chan struct{}
+}
+
+// jwksSnapshot is the key set as of a fetch. It is never modified, only replaced.
+type jwksSnapshot struct {
+	keys      []StaticKey
+	fetchedAt time.Time
+}
+
+// NewJWKS returns a new JWKS. The source is either an http(s) URL or a file path.
+func NewJWKS(source string, refreshInterval time.Duration) *JWKS {
+	return &JWKS{
+		source:          source,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: fetchTimeout},
+		now:             time.Now,
+	}
+}
+
+// Key implements KeySet.
+func (j *JWKS) Key(ctx context.Context, kid, alg string) (any, error) {
+	snapshot := j.snapshot.Load()
+	switch {
+	case snapshot == nil:
+		snapshot = j.refresh(ctx, snapshot)
+	case j.now().Sub(snapshot.fetchedAt) >= j.refreshInterval:
+		// The stale keys are still served in the meantime.
+		j.refreshInBackground(ctx, snapshot)
+	}
+
+	key, err := StaticKeys(snapshot.keys).Key(ctx, kid, alg)
+	if err == nil {
+		return key, nil
+	}
+
+	// The key may have been rotated in since the last fetch.
+	if j.now().Sub(snapshot.fetchedAt) >= minRefreshInterval {
+		snapshot = j.refresh(ctx, snapshot)
+		return StaticKeys(snapshot.keys).Key(ctx, kid, alg)
+	}
+
+	return nil, err
+}
+
+// refresh fetches the key set and replaces the cached keys, unless they were already replaced since the given
+// snapshot. On failure, the cached keys are kept. It returns the latest snapshot.
+//
+// If a refresh is already in flight, it waits for that one instead of starting another.
+func (j *JWKS) refresh(ctx context.Context, seen *jwksSnapshot) *jwksSnapshot {
+	j.mu.Lock()
+	if j.snapshot.Load() != seen {
+		j.mu.Unlock()
+		return j.latest()
+	}
+	if inflight := j.inflight; inflight != nil {
+		j.mu.Unlock()
+		select {
+		case <-inflight:
+		case <-ctx.Done():
+		}
+		return j.latest()
+	}
+	inflight := make(chan struct{})
+	j.inflight = inflight
+	j.mu.Unlock()
+
+	defer func() {
+		j.mu.Lock()
+		j.inflight = nil
+		j.mu.Unlock()
+		close(inflight)
+	}()
+
+	// Even a failed attempt counts, so an unavailable source is not retried on every request.
+	snapshot := &jwksSnapshot{fetchedAt: j.now()}
+	keys, err := j.fetch(ctx)
+	switch {
+	case err == nil:
+		snapshot.keys = keys
+	case seen != nil:
+		slog.WarnContext(ctx, "failed to refresh JWKS, using cached keys", "source", j.source, "error", err)
+		snapshot.keys = seen.keys
+	default:
+		slog.WarnContext(ctx, "failed to fetch JWKS", "source", j.source, "error", err)
+	}
+
+	j.snapshot.Store(snapshot)
+	return snapshot
+}
+
+// refreshInBackground starts a refresh that outlives the given context, unless one is already in flight.
+func (j *JWKS) refreshInBackground(ctx context.Context, seen *jwksSnapshot) {
+	j.mu.Lock()
+	busy := j.inflight != nil || j.snapshot.Load() != seen
+	j.mu.Unlock()
+
+	if !busy {
+		go j.refresh(context.WithoutCancel(ctx), seen)
+	}
+}
+
+// latest returns the cached keys, or an empty snapshot if they were never fetched.
+func (j *JWKS) latest() *jwksSnapshot {
+	if snapshot := j.snapshot.Load(); snapshot != nil {
+		return snapshot
+	}
+	return &jwksSnapshot{}
+}
+
+// fetch reads and parses the key set from its source.
+func (j *JWKS) fetch(ctx context.Context) ([]StaticKey, error) {
+	var content []byte
+	var err error
+
+	if strings.HasPrefix(j.source, "http://") || strings.HasPrefix(j.source, "https://") {
+		content, err = j.download(ctx)
+	} else {
+		content, err = os.ReadFile(j.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(content)
+}
+
+// download fetches the key set from its URL.
+func (j *JWKS) download(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	response, err := j.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected JWKS response status: %d", response.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, maxJWKSBytes))
+}
+
+// jwk is a single JSON Web Key. Only the fields required for signature verification are present.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA.
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses a key set document. Keys that are not for RS256 or ES256 signatures are skipped.
+func parseJWKS(content []byte) ([]StaticKey, error) {
+	var document struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make([]StaticKey, 0, len(document.Keys))
+	for _, entry := range document.Keys {
+		if entry.Use != "" && entry.Use != "sig" {
+			continue
+		}
+
+		var key StaticKey
+		var err error
+		switch entry.Kty {
+		case "RSA":
+			key, err = parseRSAKey(entry)
+		case "EC":
+			key, err = parseECKey(entry)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", entry.Kid, err)
+		}
+
+		// The algorithm of the key, if declared, must be the one it is used with.
+		if entry.Alg != "" && entry.Alg != key.Algorithm {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// parseRSAKey converts an RSA JWK to an RS256 key. Keys smaller than minRSAKeyBits are rejected.
+func parseRSAKey(entry jwk) (StaticKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(entry.N)
+	if err != nil {
+		return StaticKey{}, fmt.Errorf("invalid modulus: %w", err)
+	}
+	if bits := new(big.Int).SetBytes(n).BitLen(); bits < minRSAKeyBits {
+		return StaticKey{}, fmt.Errorf("key of %d bits is smaller than %d bits", bits, minRSAKeyBits)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(entry.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return StaticKey{}, errors.New("invalid exponent")
+	}
+
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	return StaticKey{ID: entry.Kid, Algorithm: RS256, Key: publicKey}, nil
+}
+
+// parseECKey converts a P-256 EC JWK to an ES256 key.
+func parseECKey(entry jwk) (StaticKey, error) {
+	if entry.Crv != "P-256" {
+		return StaticKey{}, fmt.Errorf("unsupported curve %q", entry.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(entry.X)
+	if err != nil || len(x) != 32 {
+		return StaticKey{}, errors.New("invalid x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(entry.Y)
+	if err != nil || len(y) != 32 {
+		return StaticKey{}, errors.New("invalid y coordinate")
+	}
+
+	// Parsing the uncompressed point validates that it is on the curve.
+	point := append([]byte{4}, append(x, y...)...)
+	publicKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	if err != nil {
+		return StaticKey{}, fmt.Errorf("invalid point: %w", err)
+	}
+
+	return StaticKey{ID: entry.Kid, Algorithm: ES256, Key: publicKey}, nil
+}
+
+// pickKey selects the key with the given ID from the candidates. If the ID is empty, the only candidate is picked.
+func pickKey(candidates []StaticKey, kid string) (any, error) {
+	if kid == "" {
+		if len(candidates) == 1 {
+			return candidates[0].Key, nil
+		}
+		return nil, errors.New("token has no key ID and the key is ambiguous")
+	}
+
+	for _, candidate := range candidates {
+		if candidate.ID == kid {
+			return candidate.Key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// KeySets combines multiple key sets into one. The first key set that has the requested key wins.
+type KeySets []KeySet
+
+// Key implements KeySet.
+func (k KeySets) Key(ctx context.Context, kid, alg string) (any, error) {
+	err := errors.New("no keys configured")
+	for _, set := range k {
+		var key any
+		if key, err = set.Key(ctx, kid, alg); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,207 @@
+// Package listener opens the network listeners that the http server serves on.
+//
+// Listen addresses are written as URLs:
+//   - tcp://host:port                     A TCP socket, for example "tcp://:8080".
+//   - unix:///path/to/file.sock           A Unix domain socket.
+//   - systemd://                          All sockets passed by systemd socket activation.
+//   - systemd://name                      The socket passed by systemd with the given FileDescriptorName.
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	// The first file descriptor passed by systemd. 0, 1 and 2 are stdin, stdout and stderr.
+	sdListenFDsStart = 3
+)
+
+// Listen opens a listener for each of the given addresses.
+//
+// socketPerm is the permission applied to Unix domain socket files, for example "0660". If empty, the permissions
+// are left as determined by the process umask.
+//
+// If any listener fails to open, all the already opened listeners are closed and an error is returned. Sockets passed
+// by systemd that no address selects are closed too, so they do not stay open without being served.
+func Listen(addrs []string, socketPerm string) ([]net.Listener, error) {
+	var perm os.FileMode
+	if socketPerm != "" {
+		parsed, err := strconv.ParseUint(socketPerm, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix socket permission %q: %w", socketPerm, err)
+		}
+		perm = os.FileMode(parsed)
+	}
+
+	// Sockets passed by systemd are fetched lazily and only once, since the environment is cleared after reading.
+	var systemd map[string][]net.Listener
+	var listeners []net.Listener
+	// The same systemd socket may be selected by more than one address, but it must be served only once.
+	seen := map[net.Listener]struct{}{}
+	defer func() {
+		for _, l := range systemd[""] {
+			if _, selected := seen[l]; !selected {
+				_ = l.Close()
+			}
+		}
+	}()
+
+	for _, addr := range addrs {
+		parsed, err := url.Parse(addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+
+		var opened []net.Listener
+		switch parsed.Scheme {
+		case "tcp", "tcp4", "tcp6":
+			var l net.Listener
+			l, err = net.Listen(parsed.Scheme, parsed.Host)
+			opened = []net.Listener{l}
+		case "unix":
+			var l net.Listener
+			l, err = listenUnix(parsed.Path, perm)
+			opened = []net.Listener{l}
+		case "systemd":
+			if systemd == nil {
+				systemd, err = systemdListeners()
+			}
+			opened, err = selectSystemd(systemd, parsed.Host, err)
+		default:
+			err = fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+		}
+
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("failed to listen on %q: %w", addr, err)
+		}
+		for _, l := range opened {
+			if _, exists := seen[l]; !exists {
+				seen[l] = struct{}{}
+				listeners = append(listeners, l)
+			}
+		}
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners to serve on")
+	}
+
+	return listeners, nil
+}
+
+// listenUnix opens a Unix domain socket at the given path and applies the given permissions to the socket file.
+//
+// A stale socket file left over by a crashed process is removed, but a socket that is still accepting connections is
+// never stolen from another process.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("socket path is required")
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s because: %w", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("failed to set permissions on socket %s because: %w", path, err)
+		}
+	}
+
+	return l, nil
+}
+
+// systemdListeners returns the listeners passed by systemd socket activation, grouped by their names.
+// All listeners are also available under the empty name.
+//
+// The LISTEN_* environment variables are unset afterward, so they are not inherited by child processes.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv(envListenPID)
+		_ = os.Unsetenv(envListenFDs)
+		_ = os.Unsetenv(envListenFDNames)
+	}()
+
+	// The variables are meant for this process only if the PID matches.
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets were passed by systemd")
+	}
+
+	count, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || count <= 0 {
+		return nil, errors.New("no sockets were passed by systemd")
+	}
+
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	grouped := map[string][]net.Listener{}
+
+	for i := range count {
+		fd := sdListenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		// FileListener duplicates the descriptor (with close-on-exec set), so the original is no longer required.
+		_ = file.Close()
+		if err != nil {
+			closeAll(grouped[""])
+			return nil, fmt.Errorf("failed to use systemd socket %s: %w", name, err)
+		}
+
+		grouped[name] = append(grouped[name], l)
+		grouped[""] = append(grouped[""], l)
+	}
+
+	return grouped, nil
+}
+
+// selectSystemd picks the listeners with the given name from the sockets passed by systemd.
+// An empty name selects all of them.
+func selectSystemd(grouped map[string][]net.Listener, name string, fetchErr error) ([]net.Listener, error) {
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	selected := grouped[name]
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("systemd did not pass a socket named %q", name)
+	}
+
+	return selected, nil
+}
+
+// closeAll closes all the given listeners, ignoring errors.
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
@@ -0,0 +1,334 @@
+package listener
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	testCases := []struct {
+		name string
+		// Addresses to listen on. Unix sockets are created in the given directory.
+		addrs            func(dir string) []string
+		socketPerm       string
+		expectedNetworks []string
+		errorContains    string
+	}{
+		{
+			name:             "TCP",
+			addrs:            func(string) []string { return []string{"tcp://127.0.0.1:0", "tcp4://127.0.0.1:0"} },
+			expectedNetworks: []string{"tcp", "tcp"},
+		},
+		{
+			name:             "Unix",
+			addrs:            func(dir string) []string { return []string{"unix://" + filepath.Join(dir, "api.sock")} },
+			socketPerm:       "0600",
+			expectedNetworks: []string{"unix"},
+		},
+		{
+			name: "TCP and Unix",
+			addrs: func(dir string) []string {
+				return []string{"tcp://127.0.0.1:0", "unix://" + filepath.Join(dir, "api.sock")}
+			},
+			expectedNetworks: []string{"tcp", "unix"},
+		},
+		{
+			name:          "Unsupported scheme",
+			addrs:         func(string) []string { return []string{"http://:8080"} },
+			errorContains: `unsupported scheme "http"`,
+		},
+		{
+			name:          "Invalid address",
+			addrs:         func(string) []string { return []string{"://:8080"} },
+			errorContains: "invalid listen address",
+		},
+		{
+			name:          "Missing socket path",
+			addrs:         func(string) []string { return []string{"unix://"} },
+			errorContains: "socket path is required",
+		},
+		{
+			name:          "Invalid socket permission",
+			addrs:         func(string) []string { return []string{"tcp://127.0.0.1:0"} },
+			socketPerm:    "0999",
+			errorContains: "invalid unix socket permission",
+		},
+		{
+			name:          "No systemd sockets",
+			addrs:         func(string) []string { return []string{"systemd://"} },
+			errorContains: "no sockets were passed by systemd",
+		},
+		{
+			name:          "One of many fails",
+			addrs:         func(string) []string { return []string{"tcp://127.0.0.1:0", "udp://:8080"} },
+			errorContains: `unsupported scheme "udp"`,
+		},
+		{
+			name:          "No addresses",
+			addrs:         func(string) []string { return nil },
+			errorContains: "no listeners to serve on",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listeners, err := Listen(tc.addrs(t.TempDir()), tc.socketPerm)
+			if tc.errorContains != "" {
+				require.ErrorContains(t, err, tc.errorContains)
+				require.Nil(t, listeners)
+				return
+			}
+			require.NoError(t, err)
+			defer closeAll(listeners)
+
+			networks := make([]string, len(listeners))
+			for i, l := range listeners {
+				networks[i] = l.Addr().Network()
+			}
+			require.Equal(t, tc.expectedNetworks, networks)
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	testCases := []struct {
+		name string
+		// Prepares the path before listening. The returned function cleans up after the test.
+		setup         func(t *testing.T, path string) func()
+		perm          os.FileMode
+		errorContains string
+	}{
+		{
+			name:  "New socket",
+			setup: func(*testing.T, string) func() { return func() {} },
+		},
+		{
+			name: "Stale socket is removed",
+			setup: func(t *testing.T, path string) func() {
+				// A crashed process leaves the socket file behind.
+				l, err := net.Listen("unix", path)
+				require.NoError(t, err)
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				require.NoError(t, l.Close())
+				return func() {}
+			},
+		},
+		{
+			name: "Socket in use",
+			setup: func(t *testing.T, path string) func() {
+				l, err := net.Listen("unix", path)
+				require.NoError(t, err)
+				return func() { _ = l.Close() }
+			},
+			errorContains: "is in use by another process",
+		},
+		{
+			name: "Regular file is kept",
+			setup: func(t *testing.T, path string) func() {
+				require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+				return func() {
+					content, err := os.ReadFile(path)
+					require.NoError(t, err)
+					require.Equal(t, "data", string(content))
+				}
+			},
+			errorContains: "address already in use",
+		},
+		{
+			name:  "Permissions",
+			setup: func(*testing.T, string) func() { return func() {} },
+			perm:  0o640,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "api.sock")
+			cleanup := tc.setup(t, path)
+			defer cleanup()
+
+			l, err := listenUnix(path, tc.perm)
+			if tc.errorContains != "" {
+				require.ErrorContains(t, err, tc.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = l.Close() }()
+
+			// The socket accepts connections.
+			conn, err := net.Dial("unix", path)
+			require.NoError(t, err)
+			_ = conn.Close()
+
+			if tc.perm != 0 {
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				require.Equal(t, tc.perm, info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	testCases := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{name: "Missing variables"},
+		{name: "Another process", pid: strconv.Itoa(os.Getpid() + 1), fds: "1"},
+		{name: "Invalid count", pid: strconv.Itoa(os.Getpid()), fds: "many"},
+		{name: "No sockets", pid: strconv.Itoa(os.Getpid()), fds: "0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// This test cannot run in parallel because it relies on the environment of the process.
+			t.Setenv(envListenPID, tc.pid)
+			t.Setenv(envListenFDs, tc.fds)
+			t.Setenv(envListenFDNames, "web")
+
+			_, err := systemdListeners()
+			require.ErrorContains(t, err, "no sockets were passed by systemd")
+
+			// The variables are not inherited by child processes either way.
+			for _, key := range []string{envListenPID, envListenFDs, envListenFDNames} {
+				_, exists := os.LookupEnv(key)
+				require.False(t, exists, key)
+			}
+		})
+	}
+}
+
+func TestListen_Systemd(t *testing.T) {
+	// The sockets are passed to a child process, which runs the helper test below.
+	if selection := os.Getenv("SQUELETTE_SYSTEMD_HELPER"); selection != "" {
+		systemdHelper(t, selection)
+		return
+	}
+
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = web.Close() }()
+
+	admin, err := net.Listen("unix", filepath.Join(t.TempDir(), "admin.sock"))
+	require.NoError(t, err)
+	defer func() { _ = admin.Close() }()
+
+	files := make([]*os.File, 2)
+	for i, l := range []net.Listener{web, admin} {
+		files[i], err = l.(interface{ File() (*os.File, error) }).File()
+		require.NoError(t, err)
+		defer func() { _ = files[i].Close() }()
+	}
+
+	// The web socket is told apart from the others in the child by its inode.
+	webSocket, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(files[0].Fd())))
+	require.NoError(t, err)
+
+	for _, selection := range []string{"all", "admin"} {
+		t.Run(selection, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestListen_Systemd$")
+			// The file descriptors start at 3 in the child, just like systemd passes them.
+			cmd.ExtraFiles = files
+			cmd.Env = append(os.Environ(),
+				"SQUELETTE_SYSTEMD_HELPER="+selection,
+				envListenFDs+"=2",
+				envListenFDNames+"=web:admin",
+				"SQUELETTE_SYSTEMD_ADDRS="+web.Addr().String()+","+admin.Addr().String(),
+				"SQUELETTE_SYSTEMD_WEB_SOCKET="+webSocket,
+			)
+
+			output, err := cmd.CombinedOutput()
+			require.NoError(t, err, string(output))
+		})
+	}
+}
+
+// systemdHelper runs in the child process of TestListen_Systemd, with the given selection of sockets.
+func systemdHelper(t *testing.T, selection string) {
+	// systemd sets the PID after forking, which only the child itself can do here.
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	expected := strings.Split(os.Getenv("SQUELETTE_SYSTEMD_ADDRS"), ",")
+
+	if selection == "admin" {
+		listeners, err := Listen([]string{"systemd://admin"}, "")
+		require.NoError(t, err)
+		defer closeAll(listeners)
+
+		require.Len(t, listeners, 1)
+		require.Equal(t, expected[1], listeners[0].Addr().String())
+
+		// The web socket is not selected, so it is closed.
+		entries, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		for _, entry := range entries {
+			target, _ := os.Readlink("/proc/self/fd/" + entry.Name())
+			require.NotEqual(t, os.Getenv("SQUELETTE_SYSTEMD_WEB_SOCKET"), target)
+		}
+		return
+	}
+
+	// The admin socket is selected twice, but it is served only once.
+	listeners, err := Listen([]string{"systemd://admin", "systemd://"}, "")
+	require.NoError(t, err)
+	defer closeAll(listeners)
+
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
+	}
+	require.Equal(t, []string{expected[1], expected[0]}, addrs)
+
+	// The environment is cleared once the sockets are fetched, so they cannot be fetched again.
+	_, err = Listen([]string{"systemd://web"}, "")
+	require.ErrorContains(t, err, "no sockets were passed by systemd")
+}
+
+func TestSelectSystemd(t *testing.T) {
+	web, admin := &mockListener{name: "web"}, &mockListener{name: "admin"}
+	grouped := map[string][]net.Listener{
+		"":      {web, admin},
+		"web":   {web},
+		"admin": {admin},
+	}
+
+	testCases := []struct {
+		name          string
+		selector      string
+		fetchErr      error
+		expected      []net.Listener
+		errorContains string
+	}{
+		{name: "All", selector: "", expected: []net.Listener{web, admin}},
+		{name: "By name", selector: "admin", expected: []net.Listener{admin}},
+		{name: "Unknown name", selector: "metrics", errorContains: `systemd did not pass a socket named "metrics"`},
+		{name: "Fetch error", selector: "web", fetchErr: errors.New("mock error"), errorContains: "mock error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := selectSystemd(grouped, tc.selector, tc.fetchErr)
+			if tc.errorContains != "" {
+				require.ErrorContains(t, err, tc.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, selected)
+		})
+	}
+}
+
+// mockListener is a net.Listener that only has a name, to tell listeners apart.
+type mockListener struct {
+	net.Listener
+	name string
+}
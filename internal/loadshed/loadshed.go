@@ -0,0 +1,158 @@
+// Package loadshed limits the number of requests processed concurrently, so the latency stays bounded under load.
+//
+// The limit is either fixed, or adapted to the observed latency using AIMD (additive increase, multiplicative
+// decrease): it grows slowly while the latency stays under the target, and shrinks quickly when it does not.
+// Requests over the limit wait in a short queue, and are shed if no slot frees up in time.
+package loadshed
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrShed is returned by Limiter.Acquire when the request must be rejected.
+var ErrShed = errors.New("request shed due to overload")
+
+// backoffRatio is the factor by which the adaptive limit is reduced when the latency exceeds the target.
+const backoffRatio = 0.9
+
+// Options configure a Limiter.
+type Options struct {
+	// Adaptive enables the AIMD limit. If false, MaxInFlight is used as a fixed limit.
+	Adaptive bool
+	// MinInFlight is the lowest value of the adaptive limit. It is also its initial value.
+	MinInFlight int
+	// MaxInFlight is the fixed limit, or the highest value of the adaptive limit.
+	MaxInFlight int
+	// LatencyTarget is the latency above which the adaptive limit is reduced.
+	LatencyTarget time.Duration
+	// MaxQueue is the max number of requests waiting for a slot. Any more are shed right away.
+	MaxQueue int
+	// QueueTimeout is how long a request waits for a slot before it is shed.
+	QueueTimeout time.Duration
+}
+
+// Limiter limits the number of requests in flight. It is safe for concurrent use.
+type Limiter struct {
+	opts Options
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// FIFO queue of *waiter.
+	queue *list.List
+}
+
+// waiter is a request waiting in the queue for a slot.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// New returns a new Limiter.
+func New(opts Options) *Limiter {
+	limit := float64(opts.MaxInFlight)
+	if opts.Adaptive {
+		limit = float64(opts.MinInFlight)
+	}
+
+	return &Limiter{opts: opts, limit: limit, queue: list.New()}
+}
+
+// Acquire takes a slot for a request, waiting in the queue if required.
+//
+// On success, the returned function must be called with the latency of the request once it completes. ErrShed is
+// returned if the request must be rejected, and the context error if the context is done while waiting.
+func (l *Limiter) Acquire(ctx context.Context) (func(latency time.Duration), error) {
+	l.mu.Lock()
+
+	// Fast path. A slot is available and nobody is queued ahead.
+	if l.inFlight < l.currentLimit() && l.queue.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+
+	if l.queue.Len() >= l.opts.MaxQueue {
+		l.mu.Unlock()
+		return nil, ErrShed
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.queue.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return l.release, nil
+	case <-timer.C:
+		err = ErrShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot may have been granted just as the wait ended. In that case, the request may as well proceed.
+	if w.granted {
+		return l.release, nil
+	}
+
+	l.queue.Remove(elem)
+	return nil, err
+}
+
+// release frees the slot of a completed request, and adapts the limit to its latency.
+func (l *Limiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.opts.Adaptive {
+		l.adapt(latency)
+	}
+
+	l.inFlight--
+
+	// Hand the free slots over to the queued requests.
+	for l.inFlight < l.currentLimit() && l.queue.Len() > 0 {
+		w := l.queue.Remove(l.queue.Front()).(*waiter)
+		w.granted = true
+		l.inFlight++
+		close(w.ready)
+	}
+}
+
+// adapt updates the limit using AIMD. It must be called with the mutex held.
+func (l *Limiter) adapt(latency time.Duration) {
+	if latency > l.opts.LatencyTarget {
+		l.limit = math.Max(float64(l.opts.MinInFlight), l.limit*backoffRatio)
+		return
+	}
+
+	// Grow only if the limit is actually being used, otherwise it would grow without bounds while idle.
+	if float64(l.inFlight)*2 >= l.limit {
+		// Adds up to roughly one per limit-worth of requests.
+		l.limit = math.Min(float64(l.opts.MaxInFlight), l.limit+1/l.limit)
+	}
+}
+
+// currentLimit returns the limit as a whole number. It must be called with the mutex held.
+func (l *Limiter) currentLimit() int {
+	return int(l.limit)
+}
+
+// Limit returns the current limit on the number of requests in flight.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentLimit()
+}
@@ -0,0 +1,93 @@
+package loadshed
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Fixed(t *testing.T) {
+	limiter := New(Options{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Second})
+
+	// The only slot is taken.
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+
+	// The next request waits in the queue until the slot is released.
+	acquired := make(chan error, 1)
+	go func() {
+		releaseQueued, err := limiter.Acquire(context.Background())
+		if err == nil {
+			releaseQueued(0)
+		}
+		acquired <- err
+	}()
+
+	// Wait for the request to be queued.
+	require.Eventually(t, func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return limiter.queue.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	// The queue is full, so any more requests are shed right away.
+	_, err = limiter.Acquire(context.Background())
+	require.ErrorIs(t, err, ErrShed)
+
+	// Releasing the slot lets the queued request through.
+	release(0)
+	require.NoError(t, <-acquired)
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	limiter := New(Options{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 20 * time.Millisecond})
+
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release(0)
+
+	// The queued request is shed once the timeout elapses.
+	_, err = limiter.Acquire(context.Background())
+	require.ErrorIs(t, err, ErrShed)
+
+	// The queue is empty again.
+	require.Equal(t, 0, limiter.queue.Len())
+}
+
+func TestLimiter_Adaptive(t *testing.T) {
+	limiter := New(Options{
+		Adaptive:      true,
+		MinInFlight:   10,
+		MaxInFlight:   20,
+		LatencyTarget: 100 * time.Millisecond,
+		MaxQueue:      0,
+	})
+	require.Equal(t, 10, limiter.Limit())
+
+	// Convenience function to run a batch of requests that use the whole limit with the given latency.
+	runBatch := func(latency time.Duration) {
+		var releases []func(time.Duration)
+		for range limiter.Limit() {
+			release, err := limiter.Acquire(context.Background())
+			require.NoError(t, err)
+			releases = append(releases, release)
+		}
+		for _, release := range releases {
+			release(latency)
+		}
+	}
+
+	// Fast requests grow the limit, up to the max.
+	for range 50 {
+		runBatch(10 * time.Millisecond)
+	}
+	require.Equal(t, 20, limiter.Limit())
+
+	// Slow requests shrink the limit, down to the min.
+	for range 50 {
+		runBatch(time.Second)
+	}
+	require.Equal(t, 10, limiter.Limit())
+}
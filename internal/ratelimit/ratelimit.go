@@ -0,0 +1,122 @@
+// Package ratelimit implements token bucket rate limiting with pluggable storage.
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is the configuration of a token bucket.
+type Limit struct {
+	// Rate at which tokens are added to the bucket, per second.
+	Rate float64
+	// Burst is the capacity of the bucket. A full bucket allows this many requests at once.
+	Burst int
+}
+
+// Result describes the state of a bucket after an attempt to take a token from it.
+type Result struct {
+	// Allowed is true if a token was taken.
+	Allowed bool
+	// Limit is the capacity of the bucket.
+	Limit int
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is the time until the next token is available. Zero if Allowed is true.
+	RetryAfter time.Duration
+	// ResetAfter is the time until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Store keeps the token buckets. Implementations must be safe for concurrent use.
+//
+// The in-memory implementation is local to the process. A shared implementation (like Redis) is required to enforce
+// the limits across multiple instances.
+type Store interface {
+	// Take attempts to take a token from the bucket with the given key. A missing bucket is created full.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// MemoryStore is an in-memory Store. When it holds too many buckets, the least recently used ones are evicted.
+//
+// An evicted bucket is recreated full on the next request, so the limit of maxKeys must be large enough to hold
+// all the active clients.
+type MemoryStore struct {
+	maxKeys int
+	// now is replaceable for testing.
+	now func() time.Time
+
+	mu sync.Mutex
+	// Most recently used buckets are at the front.
+	order   *list.List
+	buckets map[string]*list.Element
+}
+
+// bucket is the state of a single token bucket.
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemoryStore returns a new MemoryStore that holds at most maxKeys buckets.
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	return &MemoryStore{
+		maxKeys: maxKeys,
+		now:     time.Now,
+		order:   list.New(),
+		buckets: make(map[string]*list.Element, maxKeys),
+	}
+}
+
+// Take implements Store.
+func (m *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	now := m.now()
+	capacity := float64(limit.Burst)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b *bucket
+	if elem, exists := m.buckets[key]; exists {
+		m.order.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+		// Refill the tokens that accumulated since the last update.
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+		b.updated = now
+	} else {
+		b = &bucket{key: key, tokens: capacity, updated: now}
+		m.buckets[key] = m.order.PushFront(b)
+		m.evict()
+	}
+
+	result := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.ResetAfter = secondsToDuration((capacity - b.tokens) / limit.Rate)
+	return result, nil
+}
+
+// evict removes the least recently used buckets until the store is within its limit.
+// It must be called with the mutex held.
+func (m *MemoryStore) evict() {
+	for m.order.Len() > m.maxKeys {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.buckets, oldest.Value.(*bucket).key)
+	}
+}
+
+// secondsToDuration converts fractional seconds to a time.Duration.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore_Take(t *testing.T) {
+	// Controllable clock.
+	now := time.Now()
+	store := NewMemoryStore(100)
+	store.now = func() time.Time { return now }
+
+	limit := Limit{Rate: 1, Burst: 2}
+
+	// A new bucket is full.
+	result, err := store.Take(context.Background(), "client", limit)
+	require.NoError(t, err)
+	require.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 1, ResetAfter: time.Second}, result)
+
+	result, err = store.Take(context.Background(), "client", limit)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+	require.Equal(t, 0, result.Remaining)
+
+	// The bucket is empty.
+	result, err = store.Take(context.Background(), "client", limit)
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+	require.Equal(t, time.Second, result.RetryAfter)
+	require.Equal(t, 2*time.Second, result.ResetAfter)
+
+	// Tokens are refilled over time.
+	now = now.Add(1500 * time.Millisecond)
+	result, err = store.Take(context.Background(), "client", limit)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+	require.Equal(t, 0, result.Remaining)
+}
+
+func TestMemoryStore_Eviction(t *testing.T) {
+	store := NewMemoryStore(2)
+	limit := Limit{Rate: 0.001, Burst: 1}
+
+	// Empty the buckets of two clients.
+	for _, key := range []string{"a", "b"} {
+		result, err := store.Take(context.Background(), key, limit)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+	}
+
+	// Use "a" again, so "b" becomes the least recently used.
+	result, err := store.Take(context.Background(), "a", limit)
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+
+	// A third client evicts "b".
+	_, err = store.Take(context.Background(), "c", limit)
+	require.NoError(t, err)
+	require.Len(t, store.buckets, 2)
+	require.NotContains(t, store.buckets, "b")
+
+	// "b" starts over with a full bucket, while "a" is still limited.
+	result, err = store.Take(context.Background(), "b", limit)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+}
@@ -0,0 +1,226 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/apikey"
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/jwt"
+	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+const (
+	headerAPIKey = "X-API-Key"
+
+	// Keys to put the authenticated caller into the logging context.
+	ctxKeySubject  = "subject"
+	ctxKeyAPIKeyID = "apiKeyID"
+
+	// Sent with 401 responses, as required by RFC 6750.
+	headerWWWAuthenticate = "WWW-Authenticate"
+)
+
+// principal is the authenticated caller of a request, through either a bearer token or an API key.
+type principal struct {
+	// Exactly one of these is set.
+	claims *jwt.Claims
+	apiKey *apikey.Key
+
+	// Roles and scopes granted to the caller.
+	roles  []string
+	scopes []string
+}
+
+// id returns the ID of the caller: the subject of the bearer token, or the ID of the API key.
+func (p *principal) id() string {
+	if p.claims != nil {
+		return p.claims.Subject
+	}
+	return p.apiKey.ID
+}
+
+// principalKey is the context key for the principal of the request.
+type principalKey struct{}
+
+// principalFromContext returns the authenticated caller of the request, or nil if the request is anonymous.
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// claimsFromContext returns the verified claims of the request's bearer token, or nil if the request carries none.
+func claimsFromContext(ctx context.Context) *jwt.Claims {
+	if p := principalFromContext(ctx); p != nil {
+		return p.claims
+	}
+	return nil
+}
+
+// rolesFromClaims returns the roles granted by a bearer token, from its "roles" array claim.
+func rolesFromClaims(claims *jwt.Claims) []string {
+	return stringsFromClaim(claims, "roles")
+}
+
+// scopesFromClaims returns the scopes granted by a bearer token. They are read from the space-delimited "scope" claim
+// (RFC 8693), or the "scp" array claim used by some identity providers.
+func scopesFromClaims(claims *jwt.Claims) []string {
+	if scope, ok := claims.Raw["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	return stringsFromClaim(claims, "scp")
+}
+
+// stringsFromClaim returns the strings in the given array claim. Entries of other types are ignored.
+func stringsFromClaim(claims *jwt.Claims, name string) []string {
+	var values []string
+	if entries, ok := claims.Raw[name].([]any); ok {
+		for _, entry := range entries {
+			if s, ok := entry.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// newJWTVerifier creates the bearer token verifier from the config. It returns nil if no keys are configured.
+func newJWTVerifier(conf config.Config) (*jwt.Verifier, error) {
+	jwtConf := conf.Auth.JWT
+	if len(jwtConf.Keys) == 0 && jwtConf.JWKS == "" {
+		return nil, nil
+	}
+
+	var keySets jwt.KeySets
+
+	if len(jwtConf.Keys) > 0 {
+		staticKeys := make(jwt.StaticKeys, 0, len(jwtConf.Keys))
+		for _, key := range jwtConf.Keys {
+			staticKey := jwt.StaticKey{ID: key.ID, Algorithm: key.Algorithm, Key: []byte(key.Secret)}
+
+			if key.Algorithm != jwt.HS256 {
+				content, err := os.ReadFile(key.PublicKeyFile)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read public key of jwt key %q: %w", key.ID, err)
+				}
+				if staticKey.Key, err = jwt.ParsePublicKeyPEM(content); err != nil {
+					return nil, fmt.Errorf("invalid public key of jwt key %q: %w", key.ID, err)
+				}
+			}
+
+			staticKeys = append(staticKeys, staticKey)
+		}
+		keySets = append(keySets, staticKeys)
+	}
+
+	if jwtConf.JWKS != "" {
+		keySets = append(keySets, jwt.NewJWKS(jwtConf.JWKS, time.Duration(jwtConf.JWKSRefreshSec)*time.Second))
+	}
+
+	return jwt.NewVerifier(keySets, jwt.Options{
+		Issuer:   jwtConf.Issuer,
+		Audience: jwtConf.Audience,
+		Leeway:   time.Duration(jwtConf.LeewaySec) * time.Second,
+	}), nil
+}
+
+// authenticationMiddleware wraps the given http.Handler to authenticate requests that carry a bearer token in the
+// Authorization header.
+//
+// Requests with an invalid token are rejected with a 401. Requests without one pass through anonymously, and it is up
+// to the routes to require authentication.
+func authenticationMiddleware(next http.Handler, verifier *jwt.Verifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, token, _ := strings.Cut(authorization, " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			writeUnauthorized(w, r, `Bearer error="invalid_request"`, "unsupported authorization scheme")
+			return
+		}
+
+		claims, err := verifier.Verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			slog.InfoContext(r.Context(), "bearer token rejected", "error", err)
+			writeUnauthorized(w, r, `Bearer error="invalid_token"`, "invalid bearer token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, &principal{
+			claims: claims,
+			roles:  rolesFromClaims(claims),
+			scopes: scopesFromClaims(claims),
+		})
+		// All logs of the request, including the access log, will have the subject.
+		ctx = logger.AddContextValue(ctx, ctxKeySubject, claims.Subject)
+		// Rate limits apply per subject instead of per IP.
+		ctx = withClientIdentity(ctx, "sub:"+claims.Subject)
+
+		// Update the request in place, so the middleware that executed earlier see the new context too.
+		*r = *r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyMiddleware wraps the given http.Handler to authenticate requests that carry an API key in the X-API-Key
+// header.
+//
+// Requests with an unknown or expired key are rejected with a 401. Requests without one pass through anonymously, and
+// it is up to the routes to require authentication.
+func apiKeyMiddleware(next http.Handler, store apikey.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(headerAPIKey)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Only one set of credentials is accepted, so that it is unambiguous who the caller is.
+		if principalFromContext(r.Context()) != nil {
+			httputils.WriteErrorFor(w, r, httputils.BadRequest().WithReasonStr("multiple credentials provided"))
+			return
+		}
+
+		key, err := store.Lookup(r.Context(), apikey.Hash(secret))
+		switch {
+		case errors.Is(err, apikey.ErrNotFound):
+			writeUnauthorized(w, r, "APIKey", "invalid api key")
+			return
+		case err != nil:
+			httputils.WriteErrorFor(w, r, fmt.Errorf("failed to look up api key: %w", err))
+			return
+		case key.Expired(time.Now()):
+			slog.InfoContext(r.Context(), "expired api key rejected", ctxKeyAPIKeyID, key.ID)
+			writeUnauthorized(w, r, "APIKey", "api key expired")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, &principal{apiKey: key, roles: key.Roles, scopes: key.Scopes})
+		// All logs of the request, including the access log, will have the key ID. Never the key itself.
+		ctx = logger.AddContextValue(ctx, ctxKeyAPIKeyID, key.ID)
+		// Rate limits apply per key instead of per IP.
+		ctx = withClientIdentity(ctx, "key:"+key.ID)
+
+		// Update the request in place, so the middleware that executed earlier see the new context too.
+		*r = *r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeUnauthorized writes a 401 with the given WWW-Authenticate challenge and reason.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, challenge, reason string) {
+	w.Header().Set(headerWWWAuthenticate, challenge)
+	httputils.WriteErrorFor(w, r, httputils.Unauthorized().WithReasonStr(reason))
+}
@@ -0,0 +1,243 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/apikey"
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/jwt"
+	"github.com/shivanshkc/squelette/internal/logger"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockSecret is the HS256 secret used by the tests.
+var mockSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// mockToken returns an HS256 token with the given claims, signed with mockSecret.
+func mockToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	claimsJSON, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	mac := hmac.New(sha256.New, mockSecret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newAuthHandler returns a Handler with jwt authentication configured, so that protected routes can be registered.
+func newAuthHandler() *Handler {
+	return &Handler{jwtVerifier: jwt.NewVerifier(jwt.StaticKeys{{Algorithm: jwt.HS256, Key: mockSecret}}, jwt.Options{})}
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	writer := &bytes.Buffer{}
+	logger.Init(writer, "info", true)
+
+	verifier := jwt.NewVerifier(jwt.StaticKeys{{Algorithm: jwt.HS256, Key: mockSecret}}, jwt.Options{})
+
+	// Mock next handler that records the subject.
+	var subject string
+	mockNext := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = claimsFromContext(r.Context()).Subject
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Same order as the real handler.
+	handler := authorizationMiddleware(mockNext, policy{authenticated: true})
+	handler = authenticationMiddleware(handler, verifier)
+	handler = accessLoggerMiddleware(handler)
+
+	validToken := mockToken(t, map[string]any{"sub": "user-1", "exp": time.Now().Add(time.Minute).Unix()})
+	expiredToken := mockToken(t, map[string]any{"sub": "user-1", "exp": time.Now().Add(-time.Minute).Unix()})
+
+	testCases := []struct {
+		name              string
+		authorization     string
+		expectedCode      int
+		expectedChallenge string
+	}{
+		{name: "No token", authorization: "", expectedCode: http.StatusUnauthorized, expectedChallenge: "Bearer"},
+		{
+			name:              "Unsupported scheme",
+			authorization:     "Basic dXNlcjpwYXNz",
+			expectedCode:      http.StatusUnauthorized,
+			expectedChallenge: `Bearer error="invalid_request"`,
+		},
+		{
+			name:              "Expired token",
+			authorization:     "Bearer " + expiredToken,
+			expectedCode:      http.StatusUnauthorized,
+			expectedChallenge: `Bearer error="invalid_token"`,
+		},
+		{name: "Valid token", authorization: "Bearer " + validToken, expectedCode: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writer.Reset()
+			subject = ""
+
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+			if tc.authorization != "" {
+				request.Header.Set("Authorization", tc.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			require.Equal(t, tc.expectedCode, recorder.Code)
+			require.Equal(t, tc.expectedChallenge, recorder.Header().Get(headerWWWAuthenticate))
+
+			if tc.expectedCode == http.StatusOK {
+				require.Equal(t, "user-1", subject)
+				// The access log has the subject.
+				lines := strings.Split(strings.TrimSpace(writer.String()), "\n")
+				require.Contains(t, lines[len(lines)-1], "subject=user-1")
+			}
+		})
+	}
+}
+
+func TestRouteWithAuthentication(t *testing.T) {
+	handler := newAuthHandler()
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "GET /private", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, withAuthentication())
+
+	// Anonymous requests are rejected.
+	request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io/private", nil)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// Authenticated requests pass.
+	ctx := context.WithValue(request.Context(), principalKey{}, &principal{claims: &jwt.Claims{Subject: "user-1"}})
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request.WithContext(ctx))
+	require.Equal(t, http.StatusOK, recorder.Code)
+}
+
+// mockKeyStore is an apikey.Store backed by a map of hashes to keys.
+type mockKeyStore map[string]*apikey.Key
+
+func (m mockKeyStore) Lookup(_ context.Context, hash string) (*apikey.Key, error) {
+	key, exists := m[hash]
+	if !exists {
+		return nil, apikey.ErrNotFound
+	}
+	return key, nil
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	writer := &bytes.Buffer{}
+	logger.Init(writer, "info", true)
+
+	store := mockKeyStore{
+		apikey.Hash("valid-key"):   {ID: "billing", Scopes: []string{"invoices:read"}},
+		apikey.Hash("expired-key"): {ID: "old", ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		key          string
+		bearer       bool
+		expectedCode int
+	}{
+		{name: "No key", expectedCode: http.StatusOK},
+		{name: "Valid key", key: "valid-key", expectedCode: http.StatusOK},
+		{name: "Unknown key", key: "unknown-key", expectedCode: http.StatusUnauthorized},
+		{name: "Expired key", key: "expired-key", expectedCode: http.StatusUnauthorized},
+		{name: "Key and bearer token", key: "valid-key", bearer: true, expectedCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writer.Reset()
+
+			var caller *principal
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				caller = principalFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			handler := accessLoggerMiddleware(apiKeyMiddleware(next, store))
+
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+			if tc.key != "" {
+				request.Header.Set(headerAPIKey, tc.key)
+			}
+			if tc.bearer {
+				claims := &jwt.Claims{Subject: "user-1"}
+				*request = *request.WithContext(context.WithValue(request.Context(), principalKey{}, &principal{claims: claims}))
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedCode, recorder.Code)
+
+			if tc.expectedCode == http.StatusUnauthorized {
+				require.Equal(t, "APIKey", recorder.Header().Get(headerWWWAuthenticate))
+			}
+
+			if tc.key == "valid-key" && !tc.bearer {
+				require.NotNil(t, caller)
+				require.Equal(t, "billing", caller.apiKey.ID)
+				require.Equal(t, []string{"invoices:read"}, caller.scopes)
+
+				// The access log has the key ID, but never the key.
+				lines := strings.Split(strings.TrimSpace(writer.String()), "\n")
+				require.Contains(t, lines[len(lines)-1], "apiKeyID=billing")
+				require.NotContains(t, writer.String(), tc.key)
+			}
+		})
+	}
+}
+
+func TestRouteWithScopes(t *testing.T) {
+	handler := newAuthHandler()
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "GET /invoices", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, withScopes("invoices:read"))
+
+	for _, tc := range []struct {
+		name         string
+		caller       *principal
+		expectedCode int
+	}{
+		{name: "Anonymous", expectedCode: http.StatusUnauthorized},
+		{name: "Missing scope", caller: &principal{scopes: []string{"invoices:write"}}, expectedCode: http.StatusForbidden},
+		{name: "Has scope", caller: &principal{scopes: []string{"invoices:read"}}, expectedCode: http.StatusOK},
+		{
+			name:         "Token scopes",
+			caller:       &principal{scopes: scopesFromClaims(&jwt.Claims{Raw: map[string]any{"scope": "a invoices:read"}})},
+			expectedCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io/invoices", nil)
+			if tc.caller != nil {
+				request = request.WithContext(context.WithValue(request.Context(), principalKey{}, tc.caller))
+			}
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package rest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shivanshkc/squelette/pkg/httputils"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content codings, in the order of preference when the client accepts several equally.
+const (
+	encodingZstd   = "zstd"
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// supportedEncodings lists the supported content codings in the order of preference.
+var supportedEncodings = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+// maxZstdWindowBytes is the largest zstd window accepted in request bodies. RFC 8878 asks HTTP decoders to support
+// windows up to 8 MB, and encoders not to use larger ones.
+const maxZstdWindowBytes = 8 * 1024 * 1024
+
+// encoder is implemented by the gzip, brotli and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools keep the encoders for reuse, since they are expensive to allocate, zstd especially.
+var encoderPools = map[string]*sync.Pool{
+	encodingZstd: {New: func() any {
+		// Concurrency is disabled, because the encoder is used by a single request at a time.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+	// Level 4 is the usual tradeoff for dynamic content. Higher levels are meant for static assets.
+	encodingBrotli: {New: func() any { return brotli.NewWriterLevel(nil, 4) }},
+	encodingGzip:   {New: func() any { return gzip.NewWriter(nil) }},
+}
+
+// compressionMiddleware wraps the given http.Handler to compress response bodies in the best encoding that the client
+// accepts, as per its Accept-Encoding header.
+//
+// Bodies smaller than minSize, and content types that are already compressed (images, archives etc.) are sent as
+// they are. Streaming responses are compressed as they are flushed.
+func compressionMiddleware(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Using .Add instead of .Set because "Vary" is additive and must not overwrite values set by other middleware.
+		// The response depends on Accept-Encoding even when it is not compressed, for example because it is too small.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// Upgraded connections, like websockets, do not have a body to compress.
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The writer is not closed if the handler panics, so that the recovery middleware can still write its response.
+		cw := &compressionWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// negotiateEncoding returns the supported encoding with the highest quality in the given Accept-Encoding header, or
+// an empty string if there is none.
+func negotiateEncoding(acceptEncoding string) string {
+	var best string
+	var bestQuality float64
+
+	qualities := map[string]float64{}
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+	}
+
+	for _, encoding := range supportedEncodings {
+		quality, exists := qualities[encoding]
+		if !exists {
+			// The wildcard matches the encodings that are not listed explicitly.
+			quality, exists = qualities["*"]
+		}
+		// Ties are broken by the order of preference.
+		if exists && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+
+	return best
+}
+
+// compressibleType reports whether a response of the given content type is worth compressing. Types that are already
+// compressed, like images and archives, are not.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml",
+		"application/cbor", "application/msgpack", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressionWriter is an http.ResponseWriter that compresses the body.
+//
+// It holds back the status code and the beginning of the body until it knows whether to compress: when the body
+// reaches the min size, when it is flushed, or when the handler returns.
+type compressionWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	statusCode int
+	// The beginning of the body, held back until the decision.
+	buffer []byte
+	// Whether the decision is made, and the header is written.
+	decided bool
+	// Nil if the body is not compressed.
+	encoder encoder
+	// Hijacked connections are no longer written by the writer.
+	hijacked bool
+}
+
+func (c *compressionWriter) WriteHeader(statusCode int) {
+	// Informational responses are sent right away, and the final one follows.
+	if statusCode < http.StatusOK {
+		c.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if c.statusCode == 0 {
+		c.statusCode = statusCode
+	}
+}
+
+func (c *compressionWriter) Write(b []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.statusCode = http.StatusOK
+	}
+
+	if !c.decided {
+		c.buffer = append(c.buffer, b...)
+		if len(c.buffer) < c.minSize && !c.knownSmall() {
+			return len(b), nil
+		}
+		if err := c.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if c.encoder != nil {
+		return c.encoder.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// knownSmall reports whether the content-length header, such as the one set by httputils.WriteJson, is below the
+// min size. Such bodies can be sent without waiting for the rest of the body.
+func (c *compressionWriter) knownSmall() bool {
+	length, err := strconv.Atoi(c.Header().Get("Content-Length"))
+	return err == nil && length < c.minSize
+}
+
+// decide whether to compress the body, write the header, and then the held back beginning of the body.
+func (c *compressionWriter) decide() error {
+	c.decided = true
+
+	header := c.Header()
+	if header.Get("Content-Type") == "" && len(c.buffer) > 0 {
+		// Same as what http.ResponseWriter would do, but the type is needed for the decision.
+		header.Set("Content-Type", http.DetectContentType(c.buffer))
+	}
+
+	compress := len(c.buffer) > 0 &&
+		len(c.buffer) >= c.minSize && !c.knownSmall() &&
+		header.Get("Content-Encoding") == "" &&
+		c.statusCode != http.StatusNoContent && c.statusCode != http.StatusNotModified &&
+		compressibleType(header.Get("Content-Type"))
+
+	if compress {
+		// The length of the compressed body is not known in advance, so it is sent in chunks instead.
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", c.encoding)
+		// Byte ranges of the uncompressed body would not match the compressed one.
+		header.Del("Accept-Ranges")
+
+		c.encoder, _ = encoderPools[c.encoding].Get().(encoder)
+		c.encoder.Reset(c.ResponseWriter)
+	}
+
+	c.ResponseWriter.WriteHeader(c.statusCode)
+
+	buffer := c.buffer
+	c.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	if c.encoder != nil {
+		_, err := c.encoder.Write(buffer)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buffer)
+	return err
+}
+
+// Flush sends the body written so far to the client, compressed if applicable.
+func (c *compressionWriter) Flush() {
+	_ = c.FlushError()
+}
+
+// FlushError is like Flush but returns the error. It is used by http.ResponseController.
+func (c *compressionWriter) FlushError() error {
+	if c.hijacked {
+		return nil
+	}
+	if !c.decided {
+		// A flushed response is streamed, so it is compressed regardless of its size so far.
+		c.minSize = 0
+		if c.statusCode == 0 {
+			c.statusCode = http.StatusOK
+		}
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+	if c.encoder != nil {
+		if err := c.encoder.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying http.ResponseWriter, so that http.ResponseController can reach its features, like
+// read and write deadlines.
+func (c *compressionWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Hijack hands the connection over to the caller, as for websockets. Nothing is written by the writer afterwards.
+func (c *compressionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if c.decided {
+		return nil, nil, errors.New("cannot hijack after writing the response")
+	}
+	conn, readWriter, err := http.NewResponseController(c.ResponseWriter).Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+	return conn, readWriter, err
+}
+
+// close completes the response after the handler returns.
+func (c *compressionWriter) close() {
+	if c.hijacked {
+		return
+	}
+	if !c.decided {
+		// The body never reached the min size.
+		if c.statusCode == 0 {
+			c.statusCode = http.StatusOK
+		}
+		_ = c.decide()
+	}
+	if c.encoder != nil {
+		_ = c.encoder.Close()
+		encoderPools[c.encoding].Put(c.encoder)
+		c.encoder = nil
+	}
+}
+
+// decompressionMiddleware wraps the given http.Handler to decode request bodies sent with a gzip or zstd
+// Content-Encoding. Other encodings are rejected with a 415.
+//
+// The decoded body is limited to maxBytes, so that a small compressed body cannot expand into a huge one. The encoded
+// body is limited separately by the body size middleware.
+func decompressionMiddleware(next http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+		var decoded io.Reader
+		switch encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case encodingGzip:
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeDecodingError(w, r, err, "invalid gzip body")
+				return
+			}
+			decoded = reader
+		case encodingZstd:
+			// The window size is limited too, so that the decoder itself cannot be made to allocate too much.
+			reader, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+				zstd.WithDecoderMaxWindow(maxZstdWindowBytes))
+			if err != nil {
+				writeDecodingError(w, r, err, "invalid zstd body")
+				return
+			}
+			defer reader.Close()
+			decoded = reader
+		default:
+			// RFC 9110 asks to list the accepted encodings.
+			w.Header().Set("Accept-Encoding", encodingGzip+", "+encodingZstd)
+			httputils.WriteErrorFor(w, r, httputils.UnsupportedMediaType().WithReasonStr("unsupported content encoding"))
+			return
+		}
+
+		// The handler sees the decoded body, whose length is not known in advance.
+		r.Body = http.MaxBytesReader(w, io.NopCloser(decoded), maxBytes)
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeDecodingError responds to a decoder that failed to start, which reads the header of the body right away. The
+// body may have exceeded its size limit already, in which case the response is a 413, as with bufferBody.
+func writeDecodingError(w http.ResponseWriter, r *http.Request, err error, reason string) {
+	var errMaxBytes *http.MaxBytesError
+	if errors.As(err, &errMaxBytes) {
+		httputils.WriteErrorFor(w, r, httputils.RequestEntityTooLarge().WithReasonStr("request body too large"))
+		return
+	}
+	httputils.WriteErrorFor(w, r, httputils.BadRequest().WithReasonStr(reason))
+}
@@ -0,0 +1,251 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shivanshkc/squelette/pkg/httputils"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"gzip":                     encodingGzip,
+		"gzip, deflate, br":        encodingBrotli,
+		"gzip, deflate, br, zstd":  encodingZstd,
+		"br;q=0.5, gzip;q=0.8":     encodingGzip,
+		"zstd;q=0, gzip":           encodingGzip,
+		"*":                        encodingZstd,
+		"*;q=0.1, br;q=0.5":        encodingBrotli,
+		"GZIP":                     encodingGzip,
+		"gzip;q=0, *;q=0":          "",
+		"deflate, compress, bzip2": "",
+	}
+
+	for acceptEncoding, expected := range testCases {
+		require.Equal(t, expected, negotiateEncoding(acceptEncoding), "Accept-Encoding: %q", acceptEncoding)
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	largeBody := map[string]any{"data": strings.Repeat("squelette ", 500)}
+
+	// Decoders for each encoding.
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		encodingGzip:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		encodingBrotli: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		encodingZstd:   func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	for encoding, decode := range decoders {
+		t.Run("Large JSON with "+encoding, func(t *testing.T) {
+			handler := corsMiddleware(compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				httputils.WriteJson(w, http.StatusCreated, nil, largeBody)
+			}), 1024), []string{"*"}, 60)
+
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+			request.Header.Set("Accept-Encoding", encoding)
+			request.Header.Set("Origin", "https://example.com")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			require.Equal(t, http.StatusCreated, recorder.Code)
+			require.Equal(t, encoding, recorder.Header().Get("Content-Encoding"))
+			require.Empty(t, recorder.Header().Get("Content-Length"))
+			// Vary is additive.
+			require.ElementsMatch(t, []string{"Origin", "Accept-Encoding"}, recorder.Header().Values("Vary"))
+
+			reader, err := decode(recorder.Body)
+			require.NoError(t, err)
+			decoded, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"data":"`+largeBody["data"].(string)+`"}`, string(decoded))
+			require.Less(t, recorder.Body.Len(), len(decoded))
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "Small JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				httputils.WriteJson(w, http.StatusOK, nil, map[string]any{"code": "OK"})
+			},
+		},
+		{
+			name: "Compressed content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+			},
+		},
+		{
+			name: "Already encoded",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "gzip")
+				_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+			},
+		},
+		{
+			name:    "No body",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := compressionMiddleware(tc.handler, 1024)
+
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			// The response is exactly what the handler wrote.
+			expected := httptest.NewRecorder()
+			tc.handler(expected, request)
+
+			require.Equal(t, expected.Code, recorder.Code)
+			require.Equal(t, expected.Header().Get("Content-Encoding"), recorder.Header().Get("Content-Encoding"))
+			require.Equal(t, expected.Header().Get("Content-Length"), recorder.Header().Get("Content-Length"))
+			require.Equal(t, expected.Body.Bytes(), recorder.Body.Bytes())
+			require.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+		})
+	}
+}
+
+func TestCompressionMiddleware_Streaming(t *testing.T) {
+	release := make(chan struct{})
+
+	// Mock handler that sends an event, and then waits before sending the next.
+	handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: first\n\n"))
+		require.NoError(t, http.NewResponseController(w).Flush())
+
+		<-release
+		_, _ = w.Write([]byte("data: second\n\n"))
+	}), 1024)
+
+	server := httptest.NewServer(accessLoggerMiddleware(handler))
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	// Setting the header disables the transparent decompression by the client.
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer func() { _ = response.Body.Close() }()
+	require.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+
+	// The first event arrives before the handler returns.
+	reader, err := gzip.NewReader(response.Body)
+	require.NoError(t, err)
+	lines := bufio.NewReader(reader)
+
+	line, err := lines.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "data: first\n", line)
+
+	close(release)
+	rest, err := io.ReadAll(lines)
+	require.NoError(t, err)
+	require.Equal(t, "\ndata: second\n\n", string(rest))
+}
+
+func TestDecompressionMiddleware(t *testing.T) {
+	// Convenience function to compress the given body.
+	compress := func(encoding string, body []byte) []byte {
+		buffer := &bytes.Buffer{}
+		var writer io.WriteCloser
+		switch encoding {
+		case encodingGzip:
+			writer = gzip.NewWriter(buffer)
+		case encodingZstd:
+			writer, _ = zstd.NewWriter(buffer)
+		}
+		_, _ = writer.Write(body)
+		_ = writer.Close()
+		return buffer.Bytes()
+	}
+
+	body := []byte(`{"name":"squelette"}`)
+	// A body that is tiny when compressed, but over the limit when decompressed.
+	bomb := bytes.Repeat([]byte{'0'}, 1024*1024)
+
+	testCases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		// Limit of the encoded body, if lower than the default. The body is then sent without a Content-Length.
+		bodyLimit    int64
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "Identity", body: body, expectedCode: http.StatusOK, expectedBody: string(body)},
+		{name: "Gzip", encoding: "gzip", body: compress(encodingGzip, body), expectedCode: http.StatusOK,
+			expectedBody: string(body)},
+		{name: "Zstd", encoding: "zstd", body: compress(encodingZstd, body), expectedCode: http.StatusOK,
+			expectedBody: string(body)},
+		{name: "Gzip bomb", encoding: "gzip", body: compress(encodingGzip, bomb),
+			expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Zstd bomb", encoding: "zstd", body: compress(encodingZstd, bomb),
+			expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Invalid gzip", encoding: "gzip", body: body, expectedCode: http.StatusBadRequest},
+		{name: "Gzip header over the limit", encoding: "gzip", body: compress(encodingGzip, body), bodyLimit: 5,
+			expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Unsupported", encoding: "br", body: body, expectedCode: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Mock handler that echoes the body.
+			echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Empty(t, r.Header.Get("Content-Encoding"))
+				if body, ok := bufferBody(w, r); ok {
+					_, _ = w.Write(body)
+				}
+			})
+
+			bodyLimit := int64(maxBodyReadBytes)
+			if tc.bodyLimit > 0 {
+				bodyLimit = tc.bodyLimit
+			}
+
+			// Same order as the real handler.
+			handler := bodySizeLimitMiddleware(decompressionMiddleware(echo, maxBodyReadBytes), bodyLimit)
+
+			request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				request.Header.Set("Content-Encoding", tc.encoding)
+			}
+			if tc.bodyLimit > 0 {
+				request.ContentLength = -1
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			require.Equal(t, tc.expectedCode, recorder.Code)
+			if tc.expectedBody != "" {
+				require.Equal(t, tc.expectedBody, recorder.Body.String())
+			}
+			if tc.expectedCode == http.StatusUnsupportedMediaType {
+				require.Equal(t, "gzip, zstd", recorder.Header().Get("Accept-Encoding"))
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+)
+
+// h2cUpgrader serves HTTP/2 on cleartext connections that ask for it with "Upgrade: h2c" (RFC 7540, section 3.2).
+//
+// Prior knowledge is handled by the http server itself, but the upgrade is not supported by the standard library.
+type h2cUpgrader struct {
+	server *http2.Server
+	// The settings of the upgraded connections. This server is never started.
+	base *http.Server
+
+	// Upgraded connections are hijacked from the http server that accepted them, so they are not tracked by it.
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// newH2CUpgrader returns a new h2cUpgrader that applies the http server settings of the given config.
+func newH2CUpgrader(conf config.Config) *h2cUpgrader {
+	upgrader := &h2cUpgrader{
+		conns:  map[net.Conn]struct{}{},
+		server: &http2.Server{},
+		base: &http.Server{
+			ReadHeaderTimeout: time.Second * time.Duration(conf.HttpServer.ReadHeaderTimeoutSec),
+			IdleTimeout:       time.Second * time.Duration(conf.HttpServer.IdleTimeoutSec),
+			MaxHeaderBytes:    conf.HttpServer.MaxHeaderBytes,
+		},
+	}
+
+	if err := http2.ConfigureServer(upgrader.base, upgrader.server); err != nil {
+		panic("failed to configure the h2c server: " + err.Error())
+	}
+	return upgrader
+}
+
+// middleware wraps the given http.Handler to upgrade the connection to HTTP/2 if the request asks for it. The request
+// and all the ones after it on the same connection are then served by the given handler over HTTP/2.
+//
+// The body of the upgrade request is read into memory before it is served. So, requests with a body that is larger
+// than maxBodyReadBytes, or of unknown length, are served over HTTP/1.1 instead, as the upgrade is optional.
+func (u *h2cUpgrader) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrade := httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], "h2c") &&
+			httpguts.HeaderValuesContainsToken(r.Header["Connection"], "HTTP2-Settings") &&
+			len(r.Header["Http2-Settings"]) == 1
+		if !upgrade || r.ContentLength < 0 || r.ContentLength > maxBodyReadBytes {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A client with invalid settings is better served over HTTP/1.1 than not at all.
+		settings, err := base64.RawURLEncoding.DecodeString(r.Header.Get("HTTP2-Settings"))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		conn, err := u.hijack(w, r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to upgrade to h2c", "error", err)
+			return
+		}
+		u.track(conn)
+		defer u.untrack(conn)
+
+		u.server.ServeConn(conn, &http2.ServeConnOpts{
+			Context:        r.Context(),
+			Handler:        next,
+			BaseConfig:     u.base,
+			UpgradeRequest: r,
+			Settings:       settings,
+		})
+	})
+}
+
+// hijack reads the body of the upgrade request into memory, takes the connection over from the http server and
+// switches its protocol.
+func (u *h2cUpgrader) hijack(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	conn, buffer, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := buffer.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// The client may have sent its connection preface already, in which case it is in the buffer.
+	return &bufferedConn{Conn: conn, reader: buffer.Reader}, nil
+}
+
+// track adds the upgraded connection to the ones that shutdown waits for.
+func (u *h2cUpgrader) track(conn net.Conn) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.conns[conn] = struct{}{}
+	u.wg.Add(1)
+}
+
+// untrack closes the upgraded connection once it is served.
+func (u *h2cUpgrader) untrack(conn net.Conn) {
+	_ = conn.Close()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	delete(u.conns, conn)
+	u.wg.Done()
+}
+
+// shutdown asks the upgraded connections to go away once their active requests are done, and waits until they are
+// closed. If the context is done first, the remaining connections are closed right away and the context's error is
+// returned.
+//
+// Connections that are served on a copy of the base server, as done by the newer versions of the HTTP/2 server, cannot
+// be asked to go away. They are waited for all the same, until they are closed by the client or by the idle timeout.
+func (u *h2cUpgrader) shutdown(ctx context.Context) error {
+	if err := u.base.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for conn := range u.conns {
+		_ = conn.Close()
+	}
+	return ctx.Err()
+}
+
+// bufferedConn is a net.Conn whose reads go through a buffer, which may hold data that was read from the connection
+// before it was hijacked.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/shivanshkc/squelette/internal/idempotency"
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	// Marks the responses that are replayed from the store.
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	// Max length of an idempotency key. Keys are usually UUIDs.
+	maxIdempotencyKeyLength = 255
+)
+
+// recordingWriter is an http.ResponseWriter that keeps a copy of the response body, on top of the status code kept by
+// httputils.ResponseWriterWithCode.
+type recordingWriter struct {
+	*httputils.ResponseWriterWithCode
+	body bytes.Buffer
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriterWithCode.Write(b)
+}
+
+// idempotencyMiddleware wraps the given http.Handler to make POST and PATCH requests with an Idempotency-Key header
+// safe to retry.
+//
+// The first response for a key is stored along with a fingerprint of the request, and replayed for identical retries.
+// Reusing a key for a different request, or while the first request is still in progress, gets a 409. Server errors
+// are not stored, so those requests can be retried for real.
+func idempotencyMiddleware(next http.Handler, store idempotency.Store, trustForwardedFor bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(headerIdempotencyKey)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			httputils.WriteErrorFor(w, r, httputils.BadRequest().WithReasonStr("idempotency key too long"))
+			return
+		}
+
+		body, ok := bufferBody(w, r)
+		if !ok {
+			return
+		}
+
+		// Keys are scoped to the client, so that clients cannot see each other's responses.
+		key = clientKey(r, trustForwardedFor) + " " + key
+		fingerprint := sha256.Sum256(slices.Concat([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body))
+
+		stored, err := store.Start(r.Context(), key, hex.EncodeToString(fingerprint[:]))
+		switch {
+		case errors.Is(err, idempotency.ErrMismatch), errors.Is(err, idempotency.ErrInProgress):
+			httputils.WriteErrorFor(w, r, httputils.Conflict().WithReasonStr(err.Error()))
+			return
+		case err != nil:
+			httputils.WriteErrorFor(w, r, fmt.Errorf("failed to start idempotent request: %w", err))
+			return
+		case stored != nil:
+			replayResponse(w, stored)
+			return
+		}
+
+		// Headers set by the middleware that executed earlier, like the correlation ID, belong to this request only.
+		// Only the headers set by the handler are stored.
+		headersBefore := w.Header().Clone()
+		recorder := &recordingWriter{ResponseWriterWithCode: &httputils.ResponseWriterWithCode{ResponseWriter: w}}
+
+		// The key is released if the handler panics or fails, so that the request can be retried.
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// The request context may be canceled by now.
+			if err := store.Abandon(context.WithoutCancel(r.Context()), key); err != nil {
+				slog.ErrorContext(r.Context(), "failed to abandon idempotent request", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+		statusCode := recorder.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		if statusCode >= http.StatusInternalServerError {
+			return
+		}
+
+		response := &idempotency.Response{
+			StatusCode: statusCode,
+			Header:     headersSetAfter(headersBefore, w.Header()),
+			Body:       recorder.body.Bytes(),
+		}
+		if err := store.Complete(context.WithoutCancel(r.Context()), key, response); err != nil {
+			slog.ErrorContext(r.Context(), "failed to complete idempotent request", "error", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// replayResponse writes the stored response.
+func replayResponse(w http.ResponseWriter, response *idempotency.Response) {
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(headerIdempotentReplayed, "true")
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(response.Body)
+}
+
+// headersSetAfter returns the headers of after that are absent from, or different in, before.
+func headersSetAfter(before, after http.Header) http.Header {
+	changed := http.Header{}
+	for name, values := range after {
+		if !slices.Equal(before[name], values) {
+			changed[name] = slices.Clone(values)
+		}
+	}
+	return changed
+}
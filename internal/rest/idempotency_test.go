@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/idempotency"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteWithIdempotency(t *testing.T) {
+	// Mock handler that creates a new order on every call, and fails when asked to.
+	var calls atomic.Int32
+	create := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		id := strconv.Itoa(int(calls.Add(1)))
+		w.Header().Set("Location", "/orders/"+id)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(id))
+	}
+
+	handler := &Handler{idempotencyStore: idempotency.NewMemoryStore(time.Hour)}
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "POST /orders", create, withPublic(), withIdempotency())
+
+	// Convenience function to create an order.
+	send := func(key, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io"+target,
+			strings.NewReader(body))
+		if key != "" {
+			request.Header.Set(headerIdempotencyKey, key)
+		}
+
+		// Mock header set by an earlier middleware. It must not be stored.
+		recorder := httptest.NewRecorder()
+		recorder.Header().Set(headerCorrelationID, "correlation-"+key)
+
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// The first request is executed.
+	first := send("key-1", "/orders", `{"item":"book"}`)
+	require.Equal(t, http.StatusCreated, first.Code)
+	require.Equal(t, "1", first.Body.String())
+	require.Empty(t, first.Header().Get(headerIdempotentReplayed))
+
+	// An identical retry gets the same response, without executing again.
+	retry := send("key-1", "/orders", `{"item":"book"}`)
+	require.Equal(t, http.StatusCreated, retry.Code)
+	require.Equal(t, "1", retry.Body.String())
+	require.Equal(t, "/orders/1", retry.Header().Get("Location"))
+	require.Equal(t, "true", retry.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, "correlation-key-1", retry.Header().Get(headerCorrelationID))
+
+	// The same key with a different payload is a conflict.
+	require.Equal(t, http.StatusConflict, send("key-1", "/orders", `{"item":"pen"}`).Code)
+
+	// Requests without a key, or with a different key, are executed.
+	require.Equal(t, "2", send("", "/orders", `{"item":"book"}`).Body.String())
+	require.Equal(t, "3", send("key-2", "/orders", `{"item":"book"}`).Body.String())
+
+	// Server errors are not stored, so the retry is executed.
+	require.Equal(t, http.StatusInternalServerError, send("key-3", "/orders?fail=1", `{}`).Code)
+	require.Equal(t, http.StatusInternalServerError, send("key-3", "/orders?fail=1", `{}`).Code)
+	require.Empty(t, send("key-3", "/orders?fail=1", `{}`).Header().Get(headerIdempotentReplayed))
+}
+
+func TestRouteWithIdempotency_InProgress(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	handler := &Handler{idempotencyStore: idempotency.NewMemoryStore(time.Hour)}
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}, withPublic(), withIdempotency())
+
+	newRequest := func() *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io/orders", strings.NewReader("{}"))
+		request.Header.Set(headerIdempotencyKey, "key")
+		return request
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mux.ServeHTTP(httptest.NewRecorder(), newRequest())
+	}()
+	<-started
+
+	// A retry while the first request is in progress is a conflict.
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newRequest())
+	require.Equal(t, http.StatusConflict, recorder.Code)
+
+	close(release)
+	<-done
+
+	// Once it completes, the retry is replayed.
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newRequest())
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.Equal(t, "true", recorder.Header().Get(headerIdempotentReplayed))
+}
@@ -1,14 +1,25 @@
 package rest
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"runtime/debug"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/shivanshkc/squelette/internal/loadshed"
 	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/internal/ratelimit"
 	"github.com/shivanshkc/squelette/pkg/httputils"
 
 	"github.com/google/uuid"
@@ -26,10 +37,19 @@ const (
 	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
 	// The browser will not send the actual request after preflight if it requires headers outside of this list.
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Access-Control-Allow-Headers
-	corsAllowedHeaders = "Accept, Authorization, Content-Type, " + headerCorrelationID
+	corsAllowedHeaders = "Accept, Authorization, Content-Encoding, Content-Type, " + headerCorrelationID + ", " +
+		headerAPIKey + ", " + headerIdempotencyKey
 	// The browser javascript will be able to read only these headers.
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Access-Control-Expose-Headers
-	corsExposedHeaders = headerCorrelationID
+	corsExposedHeaders = headerCorrelationID + ", " + headerRateLimitLimit + ", " + headerRateLimitRemaining + ", " +
+		headerRateLimitReset + ", " + headerRetryAfter + ", " + headerIdempotentReplayed
+
+	// Rate limit headers.
+	// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRetryAfter         = "Retry-After"
 )
 
 // recoveryMiddleware wraps the given http.Handler with a panic recover call. This makes sure that if the app panics
@@ -41,13 +61,18 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 			if errAny == nil {
 				return
 			}
+			// The handler broke the response on purpose, like a stream that failed after its status was sent.
+			// The server closes the connection without logging it.
+			if errAny == http.ErrAbortHandler {
+				panic(errAny)
+			}
 
 			// Stack for debugging.
 			stack := string(debug.Stack())
 			slog.ErrorContext(r.Context(), "panic during request execution", "error", errAny, "stack", stack)
 
 			// Show 500 without revealing internal reason.
-			httputils.WriteError(w, httputils.InternalServerError().WithReasonStr("unknown"))
+			httputils.WriteErrorFor(w, r, httputils.InternalServerError().WithReasonStr("unknown"))
 		}()
 
 		next.ServeHTTP(w, r)
@@ -87,17 +112,15 @@ func accessLoggerMiddleware(next http.Handler) http.Handler {
 		slog.InfoContext(newCtx, "request received", "url", r.URL.String(), "method", r.Method)
 		// Release control to the next middleware or handler.
 		next.ServeHTTP(cw, r)
-		// Request exit log.
-		slog.InfoContext(newCtx, "request completed", "latency", time.Since(start), "status", cw.StatusCode)
+		// Request exit log. The request context is used again, since the later middleware may have added values to it,
+		// like the authenticated subject.
+		slog.InfoContext(r.Context(), "request completed", "latency", time.Since(start), "status", cw.StatusCode)
 	})
 }
 
-// corsMiddleware wraps the given http.Handler to apply a strict, browser-correct CORS policy.
-// It adds CORS headers (Access-Control-XXX-XXX) to the response for allowed origins only, short-circuits preflight
-// requests, and leaves non-browser clients unaffected.
-//
-// TODO: Trim origin values?
-func corsMiddleware(next http.Handler, origins []string, maxAgeSec int) http.Handler {
+// originMatcher returns a function that reports whether the origin is one of the given allowed origins. The "*" origin
+// allows all of them.
+func originMatcher(origins []string) func(origin string) bool {
 	// To easily handle cases where "*" is allowed.
 	allowAllOrigins := slices.Contains(origins, "*")
 	// For easy lookups.
@@ -106,8 +129,7 @@ func corsMiddleware(next http.Handler, origins []string, maxAgeSec int) http.Han
 		allowedOrigins[o] = struct{}{}
 	}
 
-	// Convenience function. Makes the code below much more readable.
-	isOriginAllowed := func(origin string) bool {
+	return func(origin string) bool {
 		if allowAllOrigins {
 			return true
 		}
@@ -115,6 +137,15 @@ func corsMiddleware(next http.Handler, origins []string, maxAgeSec int) http.Han
 		_, allowed := allowedOrigins[origin]
 		return allowed
 	}
+}
+
+// corsMiddleware wraps the given http.Handler to apply a strict, browser-correct CORS policy.
+// It adds CORS headers (Access-Control-XXX-XXX) to the response for allowed origins only, short-circuits preflight
+// requests, and leaves non-browser clients unaffected.
+//
+// TODO: Trim origin values?
+func corsMiddleware(next http.Handler, origins []string, maxAgeSec int) http.Handler {
+	isOriginAllowed := originMatcher(origins)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
@@ -172,9 +203,421 @@ func corsMiddleware(next http.Handler, origins []string, maxAgeSec int) http.Han
 }
 
 // bodySizeLimitMiddleware wraps the given http.Handler to apply a max read limit on the request body.
+//
+// Bodies that declare a larger Content-Length are rejected with a 413 right away. Others get an *http.MaxBytesError
+// upon reading past the limit.
 func bodySizeLimitMiddleware(next http.Handler, maxBytes int64) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			httputils.WriteErrorFor(w, r, httputils.RequestEntityTooLarge().WithReasonStr("request body too large"))
+			return
+		}
+
 		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// uploadLimitMiddleware wraps the given http.Handler to respond with a 413 as soon as the handler reads past the body
+// limit, which must be applied by the body size middleware before it.
+//
+// It is meant for uploads, which are read as they arrive instead of being buffered. The handler only sees a read
+// error, and its own response to it is discarded.
+//
+// Since an upload takes as long as the client's bandwidth requires, the given write timeout only starts once the body
+// is read in full, or the response is started, whichever comes first. The write deadline must be cleared before.
+func uploadLimitMiddleware(next http.Handler, writeTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uw := &uploadLimitWriter{ResponseWriter: w, request: r, writeTimeout: writeTimeout}
+		r.Body = &uploadLimitReader{ReadCloser: r.Body, writer: uw}
+		next.ServeHTTP(uw, r)
+	})
+}
+
+// uploadLimitReader reports reads past the body limit to its uploadLimitWriter.
+type uploadLimitReader struct {
+	io.ReadCloser
+	writer *uploadLimitWriter
+}
+
+func (u *uploadLimitReader) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+
+	var errMaxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &errMaxBytes):
+		u.writer.exceed()
+	case errors.Is(err, io.EOF):
+		u.writer.startWriteDeadline()
+	}
+	return n, err
+}
+
+// uploadLimitWriter is an http.ResponseWriter that responds with a 413 once the body limit is exceeded, and discards
+// the writes of the handler after that.
+type uploadLimitWriter struct {
+	http.ResponseWriter
+	// The request, for the error response.
+	request *http.Request
+	// The write deadline starts only once, when the response is about to be written.
+	writeTimeout time.Duration
+	deadlineOnce sync.Once
+
+	// The handler may read the body and write the response from different goroutines.
+	mutex       sync.Mutex
+	wroteHeader bool
+	exceeded    bool
+}
+
+func (u *uploadLimitWriter) WriteHeader(statusCode int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.exceeded {
+		return
+	}
+	u.startWriteDeadline()
+	u.wroteHeader = true
+	u.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (u *uploadLimitWriter) Write(b []byte) (int, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.exceeded {
+		// Pretend success, since the handler cannot do anything about it.
+		return len(b), nil
+	}
+	u.startWriteDeadline()
+	u.wroteHeader = true
+	return u.ResponseWriter.Write(b)
+}
+
+// Flush forwards http.Flusher when supported.
+func (u *uploadLimitWriter) Flush() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if f, ok := u.ResponseWriter.(http.Flusher); ok && !u.exceeded {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter, so that http.ResponseController can reach its features.
+func (u *uploadLimitWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+// exceed writes the 413 response, unless the handler has already started its own.
+func (u *uploadLimitWriter) exceed() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.exceeded {
+		return
+	}
+	u.exceeded = true
+
+	if !u.wroteHeader {
+		u.startWriteDeadline()
+		err := httputils.RequestEntityTooLarge().WithReasonStr("request body too large")
+		httputils.WriteErrorFor(u.ResponseWriter, u.request, err)
+	}
+}
+
+// startWriteDeadline sets the write deadline of the upload, if it is not set yet. A zero timeout leaves it cleared.
+func (u *uploadLimitWriter) startWriteDeadline() {
+	u.deadlineOnce.Do(func() {
+		if u.writeTimeout <= 0 {
+			return
+		}
+		controller := http.NewResponseController(u.ResponseWriter)
+		if err := controller.SetWriteDeadline(time.Now().Add(u.writeTimeout)); err != nil {
+			slog.WarnContext(u.request.Context(), "failed to set write deadline", "error", err)
+		}
+	})
+}
+
+// bufferBody reads the request body in full, and replaces it with a copy so the handler can still read it.
+//
+// If the body cannot be read, it writes the error response and returns false. A body over the limit of the body size
+// middleware gets a 413.
+func bufferBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var errMaxBytes *http.MaxBytesError
+		if errors.As(err, &errMaxBytes) {
+			httputils.WriteErrorFor(w, r, httputils.RequestEntityTooLarge().WithReasonStr("request body too large"))
+			return nil, false
+		}
+		httputils.WriteErrorFor(w, r, httputils.BadRequest().WithReasonStr("failed to read request body"))
+		return nil, false
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// deadlineMiddleware wraps the given http.Handler to apply read and write deadlines on the underlying connection for
+// the duration of the request. A zero timeout clears the corresponding deadline.
+//
+// The deadlines are applied by the handler instead of the http.Server, so long-lived routes like websockets can be
+// exempt. The middleware may be applied more than once, in which case the innermost deadlines win.
+func deadlineMiddleware(next http.Handler, readTimeout, writeTimeout time.Duration) http.Handler {
+	// Convenience function. A zero timeout means no deadline.
+	deadline := func(now time.Time, timeout time.Duration) time.Time {
+		if timeout <= 0 {
+			return time.Time{}
+		}
+		return now.Add(timeout)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller := http.NewResponseController(w)
+		now := time.Now()
+
+		// The deadlines are always set, even if zero, because the server does not reset the write deadline between
+		// requests on a keep-alive connection.
+		if err := controller.SetReadDeadline(deadline(now, readTimeout)); err != nil {
+			slog.WarnContext(r.Context(), "failed to set read deadline", "error", err)
+		}
+		if err := controller.SetWriteDeadline(deadline(now, writeTimeout)); err != nil {
+			slog.WarnContext(r.Context(), "failed to set write deadline", "error", err)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware wraps the given http.Handler to put a deadline on the request context.
+//
+// If the deadline passes before the handler has written anything, a 503 is written to the client right away. Any
+// later writes by the handler are discarded and fail with http.ErrHandlerTimeout. The handler is expected to observe
+// the context and return soon after.
+//
+// Unlike http.TimeoutHandler, the response is not buffered, so flushing and streaming keep working.
+func timeoutMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+
+		// Convenience function to respond on behalf of the handler, if it has not responded yet.
+		respondTimeout := func() {
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			// Nothing to do if the client went away or the handler has already responded.
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) || tw.wroteHeader || tw.timedOut || tw.done {
+				return
+			}
+			tw.timedOut = true
+
+			slog.WarnContext(ctx, "request timed out", "timeout", timeout)
+			httputils.WriteErrorFor(w, r, httputils.ServiceUnavailable().WithReasonStr("request timed out"))
+			// Send the response now, without waiting for the handler to return.
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+
+		// Respond as soon as the deadline passes.
+		stop := context.AfterFunc(ctx, respondTimeout)
+
+		next.ServeHTTP(tw, r.WithContext(ctx))
+
+		// The handler may have returned upon the deadline before the timeout response was written.
+		stop()
+		respondTimeout()
+
+		// The writer must not be touched after this middleware returns.
+		tw.mu.Lock()
+		tw.done = true
+		tw.mu.Unlock()
+	})
+}
+
+// timeoutWriter is the http.ResponseWriter used by timeoutMiddleware. It guards the underlying writer against
+// concurrent use by the handler and the timeout response.
+type timeoutWriter struct {
+	http.ResponseWriter
+
+	// The handler gets its own header map, so it does not race with the timeout response.
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	done        bool
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *timeoutWriter) WriteHeader(statusCode int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeHeaderLocked(statusCode)
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.writeHeaderLocked(http.StatusOK)
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush forwards http.Flusher when supported. It is a no-op after a timeout.
+func (t *timeoutWriter) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timedOut {
+		return
+	}
+	t.writeHeaderLocked(http.StatusOK)
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (t *timeoutWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// writeHeaderLocked copies the handler's headers to the underlying writer and writes the status code, if not already
+// done. It must be called with the mutex held.
+func (t *timeoutWriter) writeHeaderLocked(statusCode int) {
+	if t.wroteHeader || t.timedOut {
+		return
+	}
+	t.wroteHeader = true
+
+	dst := t.ResponseWriter.Header()
+	clear(dst)
+	for key, values := range t.header {
+		dst[key] = values
+	}
+	t.ResponseWriter.WriteHeader(statusCode)
+}
+
+// rateLimitMiddleware wraps the given http.Handler to apply a token bucket rate limit per client.
+//
+// Buckets are kept per group, so all routes of a group share the same limit. Clients are identified by their
+// authenticated identity if available, and by their IP address otherwise.
+func rateLimitMiddleware(next http.Handler, store ratelimit.Store, group string, limit ratelimit.Limit,
+	trustForwardedFor bool,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := group + "|" + clientKey(r, trustForwardedFor)
+
+		result, err := store.Take(r.Context(), key, limit)
+		if err != nil {
+			// Fail open. An unavailable store must not take the whole API down.
+			slog.ErrorContext(r.Context(), "failed to apply rate limit", "group", group, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(headerRateLimitLimit, strconv.Itoa(result.Limit))
+		w.Header().Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+		w.Header().Set(headerRateLimitReset, ceilSeconds(result.ResetAfter))
+
+		if !result.Allowed {
+			w.Header().Set(headerRetryAfter, ceilSeconds(result.RetryAfter))
+			httputils.WriteErrorFor(w, r, httputils.TooManyRequests().WithReasonStr("rate limit exceeded"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIdentityKey is the context key for the identity of an authenticated client.
+type clientIdentityKey struct{}
+
+// withClientIdentity returns a new context that carries the identity of the authenticated client, like
+// "sub:<subject>". It is meant to be called by authentication middleware.
+func withClientIdentity(parent context.Context, identity string) context.Context {
+	return context.WithValue(parent, clientIdentityKey{}, identity)
+}
+
+// clientKey identifies the client of the request for rate limiting.
+//
+// Only authenticated identities are trusted. Unverified credentials, like a random API key, are never used, because
+// a client could send a new one with every request to get a fresh bucket.
+func clientKey(r *http.Request, trustForwardedFor bool) string {
+	if identity, ok := r.Context().Value(clientIdentityKey{}).(string); ok && identity != "" {
+		return identity
+	}
+	return "ip:" + clientIP(r, trustForwardedFor)
+}
+
+// clientIP returns the IP address of the client. IPv6 addresses are truncated to their /64 prefix, since a single
+// client usually controls a whole /64.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		address = host
+	}
+
+	// The last address is the one appended by the closest proxy, so it cannot be spoofed by the client.
+	if forwarded := r.Header.Values("X-Forwarded-For"); trustForwardedFor && len(forwarded) > 0 {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+			address = last
+		}
+	}
+
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		// Unix domain sockets, for example.
+		return address
+	}
+
+	ip = ip.Unmap()
+	if ip.Is6() {
+		return netip.PrefixFrom(ip, 64).Masked().String()
+	}
+	return ip.String()
+}
+
+// ceilSeconds formats the given duration as whole seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// loadSheddingMiddleware wraps the given http.Handler to limit the number of requests in flight. Requests over the
+// limit wait briefly for a slot, and are rejected with a 503 if none frees up.
+//
+// retryAfter is the value of the Retry-After header sent with rejected requests, in seconds.
+func loadSheddingMiddleware(next http.Handler, limiter *loadshed.Limiter, retryAfter string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := limiter.Acquire(r.Context())
+		if err != nil {
+			// The client went away while queued, so there is nobody to respond to, and nothing was shed.
+			if r.Context().Err() != nil {
+				return
+			}
+
+			slog.WarnContext(r.Context(), "request shed", "limit", limiter.Limit(), "error", err)
+			w.Header().Set(headerRetryAfter, retryAfter)
+			httputils.WriteErrorFor(w, r, httputils.ServiceUnavailable().WithReasonStr("server overloaded"))
+			return
+		}
+
+		// The latency is measured even if the handler panics, so the slot is never leaked.
+		start := time.Now()
+		defer func() { release(time.Since(start)) }()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -3,18 +3,27 @@ package rest
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/loadshed"
 	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/internal/ratelimit"
 	"github.com/shivanshkc/squelette/pkg/httputils"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 func TestRecoveryMiddleware(t *testing.T) {
@@ -42,6 +51,14 @@ func TestRecoveryMiddleware(t *testing.T) {
 	// Verify response body.
 	require.Equal(t, httputils.InternalServerError().Status, responseBody["status"])
 	require.Equal(t, "unknown", responseBody["reason"])
+
+	// Deliberately aborted responses are left to the server.
+	handler = recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	})
 }
 
 func TestAccessLoggerMiddleware(t *testing.T) {
@@ -212,3 +229,339 @@ func TestCorsMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddleware_H2C(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	// Mock handler that streams two chunks, flushing after each one.
+	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		for _, chunk := range []string{"first\n", "second\n"} {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	// Same chain as the real handler, minus the routing.
+	var next http.Handler = mockHandler
+	next = bodySizeLimitMiddleware(next, maxBodyReadBytes)
+	next = corsMiddleware(next, []string{"*"}, 60)
+	next = accessLoggerMiddleware(next)
+	next = recoveryMiddleware(next)
+
+	// Server that speaks cleartext HTTP/2 with prior knowledge.
+	server := httptest.NewUnstartedServer(next)
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	// Client that speaks cleartext HTTP/2 only.
+	transport := &http.Transport{Protocols: &http.Protocols{}}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+
+	response, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer func() { _ = response.Body.Close() }()
+
+	// Verify that HTTP/2 was used and the middleware chain worked.
+	require.Equal(t, 2, response.ProtoMajor)
+	require.Equal(t, http.StatusAccepted, response.StatusCode)
+	require.NotEmpty(t, response.Header.Get(headerCorrelationID))
+
+	body := &bytes.Buffer{}
+	_, err = body.ReadFrom(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", body.String())
+}
+
+func TestMiddleware_H2CUpgrade(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	// Mock handler that echoes the request body.
+	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(body)
+	})
+
+	upgrader := newH2CUpgrader(config.Config{})
+	server := httptest.NewServer(upgrader.middleware(recoveryMiddleware(mockHandler)))
+	defer server.Close()
+
+	t.Run("Upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		// The client's settings are empty, so the defaults apply.
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: squelette.shivansh.io\r\nContent-Length: 5\r\n" +
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\nhello"))
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+		require.Equal(t, "h2c", response.Header.Get("Upgrade"))
+
+		// The connection speaks HTTP/2 from here on, and the upgrade request is answered on stream 1.
+		_, err = conn.Write([]byte(http2.ClientPreface))
+		require.NoError(t, err)
+		framer := http2.NewFramer(conn, reader)
+		require.NoError(t, framer.WriteSettings())
+
+		var status string
+		decoder := hpack.NewDecoder(4096, func(field hpack.HeaderField) {
+			if field.Name == ":status" {
+				status = field.Value
+			}
+		})
+
+		body := &bytes.Buffer{}
+		for ended := false; !ended; {
+			frame, err := framer.ReadFrame()
+			require.NoError(t, err)
+
+			switch frame := frame.(type) {
+			case *http2.HeadersFrame:
+				_, err = decoder.Write(frame.HeaderBlockFragment())
+				require.NoError(t, err)
+			case *http2.DataFrame:
+				body.Write(frame.Data())
+				ended = frame.StreamEnded()
+			}
+		}
+
+		// The response came over HTTP/2, along with the body of the upgrade request.
+		require.Equal(t, "202", status)
+		require.Equal(t, "hello", body.String())
+
+		// The shutdown waits for the upgraded connection, which the client keeps open.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, upgrader.shutdown(ctx), context.DeadlineExceeded)
+
+		// The connection is closed once the shutdown times out, possibly after it was asked to go away.
+		for err == nil {
+			_, err = framer.ReadFrame()
+		}
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Large body is served over HTTP/1.1", func(t *testing.T) {
+		body := bytes.Repeat([]byte("a"), maxBodyReadBytes+1)
+		request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+		request.Header.Set("Upgrade", "h2c")
+		request.Header.Set("HTTP2-Settings", "")
+
+		response, err := server.Client().Do(request)
+		require.NoError(t, err)
+		defer func() { _ = response.Body.Close() }()
+
+		responseBody, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.Equal(t, 1, response.ProtoMajor)
+		require.Equal(t, http.StatusAccepted, response.StatusCode)
+		require.Equal(t, body, responseBody)
+	})
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	timeout := 50 * time.Millisecond
+
+	t.Run("Handler responds in time", func(t *testing.T) {
+		mockNext := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Mock", "value")
+			httputils.WriteJson(w, http.StatusCreated, nil, map[string]any{"code": "OK"})
+		})
+
+		request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+		recorder := httptest.NewRecorder()
+		timeoutMiddleware(mockNext, timeout).ServeHTTP(recorder, request)
+
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.Equal(t, "value", recorder.Header().Get("X-Mock"))
+		require.JSONEq(t, `{"code":"OK"}`, recorder.Body.String())
+	})
+
+	t.Run("Handler misses the deadline", func(t *testing.T) {
+		// The late write by the handler is captured for verification.
+		var lateWriteErr error
+		mockNext := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			// Give the timeout response some time to be written.
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("X-Mock", "value")
+			_, lateWriteErr = w.Write([]byte("late"))
+		})
+
+		request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+		recorder := httptest.NewRecorder()
+		timeoutMiddleware(mockNext, timeout).ServeHTTP(recorder, request)
+
+		// Verify that the timeout response was written and the late write was discarded.
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Empty(t, recorder.Header().Get("X-Mock"))
+		require.ErrorIs(t, lateWriteErr, http.ErrHandlerTimeout)
+
+		responseBody := map[string]any{}
+		err := json.NewDecoder(recorder.Body).Decode(&responseBody)
+		require.NoError(t, err)
+		require.Equal(t, httputils.ServiceUnavailable().Status, responseBody["status"])
+	})
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	// Practically no refill during the test, so only the burst is available.
+	limit := ratelimit.Limit{Rate: 0.001, Burst: 2}
+	store := ratelimit.NewMemoryStore(100)
+
+	mockNext := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimitMiddleware(mockNext, store, "default", limit, true)
+
+	// Convenience function to send a request from the given client.
+	send := func(remoteAddr, forwardedFor, identity string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+		request.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if identity != "" {
+			request = request.WithContext(withClientIdentity(request.Context(), identity))
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// The burst is allowed.
+	recorder := send("10.0.0.1:1234", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get(headerRateLimitLimit))
+	require.Equal(t, "1", recorder.Header().Get(headerRateLimitRemaining))
+
+	// A different port is the same client.
+	recorder = send("10.0.0.1:5678", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "0", recorder.Header().Get(headerRateLimitRemaining))
+
+	// Beyond the burst, the client is limited.
+	recorder = send("10.0.0.1:1234", "", "")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.NotEmpty(t, recorder.Header().Get(headerRetryAfter))
+
+	responseBody := map[string]any{}
+	err := json.NewDecoder(recorder.Body).Decode(&responseBody)
+	require.NoError(t, err)
+	require.Equal(t, httputils.TooManyRequests().Status, responseBody["status"])
+
+	// The last forwarded address identifies the client behind a proxy.
+	recorder = send("10.0.0.1:1234", "203.0.113.9, 10.0.0.2", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// Addresses in the same IPv6 /64 are the same client.
+	require.Equal(t, http.StatusOK, send("[2001:db8::1]:1234", "", "").Code)
+	require.Equal(t, http.StatusOK, send("[2001:db8::2]:1234", "", "").Code)
+	require.Equal(t, http.StatusTooManyRequests, send("[2001:db8::3]:1234", "", "").Code)
+
+	// An authenticated client is limited by its identity, not its IP.
+	recorder = send("10.0.0.1:1234", "", "sub:user-1")
+	require.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestLoadSheddingMiddleware(t *testing.T) {
+	// Only one request at a time, and no queue.
+	limiter := loadshed.New(loadshed.Options{MaxInFlight: 1})
+
+	// Mock handler that blocks until told otherwise.
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	mockNext := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := loadSheddingMiddleware(mockNext, limiter, "3")
+
+	// The first request takes the only slot.
+	firstRecorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+		handler.ServeHTTP(firstRecorder, request)
+	}()
+	<-entered
+
+	// The second request is shed.
+	request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, "3", recorder.Header().Get(headerRetryAfter))
+
+	// The first request completes normally.
+	close(unblock)
+	<-done
+	require.Equal(t, http.StatusOK, firstRecorder.Code)
+}
+
+func TestLoadSheddingMiddleware_ClientGone(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logs := &bytes.Buffer{}
+	logger.Init(logs, "debug", false)
+
+	// Only one request at a time, and a queue that is long enough for the client to give up.
+	limiter := loadshed.New(loadshed.Options{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release(0)
+
+	handler := loadSheddingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request was served without a slot")
+	}), limiter, "3")
+
+	// The client disconnects while its request is queued.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	request := httptest.NewRequestWithContext(ctx, http.MethodGet, "https://squelette.shivansh.io", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	// Nothing is written to the gone client, and the request is not reported as shed.
+	require.False(t, recorder.Flushed)
+	require.Empty(t, recorder.Body.String())
+	require.Empty(t, recorder.Header().Get(headerRetryAfter))
+	require.NotContains(t, logs.String(), "request shed")
+}
+
+func TestProblemExtensions(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger and problem options.
+	logger.Init(&bytes.Buffer{}, "info", true)
+	httputils.SetProblemOptions(httputils.ProblemOptions{Always: true, Extensions: problemExtensions})
+	t.Cleanup(func() { httputils.SetProblemOptions(httputils.ProblemOptions{}) })
+
+	handler := accessLoggerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httputils.WriteErrorFor(w, r, httputils.NotFound())
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io/users/1", nil)
+	request.Header.Set(headerCorrelationID, "correlation-1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	require.Equal(t, httputils.ProblemContentType, recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"instance":"/users/1",`+
+		`"correlationID":"correlation-1"}`, recorder.Body.String())
+}
@@ -0,0 +1,184 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+// ownershipCheck reports whether the caller owns the resource targeted by the request, usually by comparing a path
+// value with the caller's ID. It may query the database.
+type ownershipCheck func(r *http.Request, caller *principal) (bool, error)
+
+// policy is the authorization policy of a route. Every route must declare one, even if it is public, so that no route
+// is left unprotected by accident.
+type policy struct {
+	// Public routes are open to anonymous callers. They cannot have any other requirement.
+	public bool
+	// Authenticated routes reject anonymous callers. Implied by all the requirements below.
+	authenticated bool
+	// The caller must have at least one of these roles.
+	roles []string
+	// The caller must have all of these scopes.
+	scopes []string
+	// The caller must own the targeted resource.
+	owner ownershipCheck
+
+	// Name of the webhook from the config that the route receives. Webhook routes are called by partners, which
+	// authenticate by signing their requests instead.
+	webhook string
+}
+
+// withPublic makes the route open to anonymous callers.
+func withPublic() routeOption {
+	return func(rt *route) { rt.policy.public = true }
+}
+
+// withAuthentication makes the route reject anonymous callers.
+func withAuthentication() routeOption {
+	return func(rt *route) { rt.policy.authenticated = true }
+}
+
+// withRoles makes the route require a caller with at least one of the given roles.
+func withRoles(roles ...string) routeOption {
+	return func(rt *route) {
+		rt.policy.authenticated = true
+		rt.policy.roles = append(rt.policy.roles, roles...)
+	}
+}
+
+// withScopes makes the route require a caller with all the given scopes.
+func withScopes(scopes ...string) routeOption {
+	return func(rt *route) {
+		rt.policy.authenticated = true
+		rt.policy.scopes = append(rt.policy.scopes, scopes...)
+	}
+}
+
+// withOwnership makes the route require a caller that owns the targeted resource, as reported by the given check.
+func withOwnership(check ownershipCheck) routeOption {
+	return func(rt *route) {
+		rt.policy.authenticated = true
+		rt.policy.owner = check
+	}
+}
+
+// withWebhook makes the route receive the given webhook, so it accepts only requests signed with its secrets. The
+// webhook must be present in the config.
+func withWebhook(name string) routeOption {
+	return func(rt *route) { rt.policy.webhook = name }
+}
+
+// validate returns an error if the policy is absent or contradictory.
+func (p policy) validate() error {
+	var kinds int
+	for _, set := range []bool{p.public, p.authenticated, p.webhook != ""} {
+		if set {
+			kinds++
+		}
+	}
+
+	switch kinds {
+	case 0:
+		return errors.New("no authorization policy, use withPublic() if the route is meant to be open")
+	case 1:
+		return nil
+	default:
+		return errors.New("route can only be one of public, protected and webhook")
+	}
+}
+
+// String describes the policy, like "public" or "roles=admin scopes=invoices:read owner".
+func (p policy) String() string {
+	if p.public {
+		return "public"
+	}
+	if p.webhook != "" {
+		return "webhook=" + p.webhook
+	}
+
+	var parts []string
+	if len(p.roles) > 0 {
+		parts = append(parts, "roles="+strings.Join(p.roles, ","))
+	}
+	if len(p.scopes) > 0 {
+		parts = append(parts, "scopes="+strings.Join(p.scopes, ","))
+	}
+	if p.owner != nil {
+		parts = append(parts, "owner")
+	}
+
+	if len(parts) == 0 {
+		return "authenticated"
+	}
+	return strings.Join(parts, " ")
+}
+
+// policies returns the authorization policy of every registered route, keyed by the route pattern.
+//
+// This is the one place to see which routes are public and which are protected.
+func (h *Handler) policies() map[string]string {
+	policies := make(map[string]string, len(h.routes))
+	for _, rt := range h.routes {
+		policies[rt.pattern] = rt.policy.String()
+	}
+	return policies
+}
+
+// authorizationMiddleware wraps the given http.Handler to enforce the given policy.
+//
+// Anonymous callers are rejected with a 401, and the ones that do not satisfy the policy with a 403.
+func authorizationMiddleware(next http.Handler, pol policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := principalFromContext(r.Context())
+		if caller == nil {
+			writeUnauthorized(w, r, "Bearer", "authentication required")
+			return
+		}
+
+		if len(pol.roles) > 0 && !slices.ContainsFunc(pol.roles, func(role string) bool {
+			return slices.Contains(caller.roles, role)
+		}) {
+			httputils.WriteErrorFor(w, r, httputils.Forbidden().WithReasonStr("missing role"))
+			return
+		}
+
+		for _, scope := range pol.scopes {
+			if !slices.Contains(caller.scopes, scope) {
+				httputils.WriteErrorFor(w, r, httputils.Forbidden().WithReasonStr("missing scope: "+scope))
+				return
+			}
+		}
+
+		if pol.owner != nil {
+			owner, err := pol.owner(r, caller)
+			if err != nil {
+				httputils.WriteErrorFor(w, r, fmt.Errorf("failed to check resource ownership: %w", err))
+				return
+			}
+			if !owner {
+				httputils.WriteErrorFor(w, r, httputils.Forbidden().WithReasonStr("not the owner of the resource"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkPolicy panics if the route's policy is absent or contradictory, or if it requires authentication while no
+// authentication is configured, so that mistakes are caught at startup.
+func (h *Handler) checkPolicy(rt *route) {
+	if err := rt.policy.validate(); err != nil {
+		panic(fmt.Sprintf("route %q: %s", rt.pattern, err))
+	}
+	// Every caller would be anonymous, so the route would reject every request.
+	if rt.policy.authenticated && h.jwtVerifier == nil && h.apiKeyStore == nil {
+		panic(fmt.Sprintf("route %q requires authentication, but neither jwt nor api key authentication is configured",
+			rt.pattern))
+	}
+}
@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shivanshkc/squelette/internal/apikey"
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/jwt"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRoutePolicies pins the authorization policy of every route of the real handler. Update it when adding routes.
+func TestRoutePolicies(t *testing.T) {
+	handler := NewHandler(config.Config{})
+	require.Equal(t, map[string]string{
+		"GET /api": "public",
+	}, handler.policies())
+}
+
+func TestRoutePolicies_Check(t *testing.T) {
+	okHandler := func(w http.ResponseWriter, r *http.Request) {}
+
+	// Routes without a policy are rejected, and not registered.
+	unregistered := &Handler{}
+	require.PanicsWithValue(t,
+		`route "GET /unknown": no authorization policy, use withPublic() if the route is meant to be open`,
+		func() { unregistered.handle(http.NewServeMux(), config.Config{}, "GET /unknown", okHandler) },
+	)
+	require.Empty(t, unregistered.routes)
+
+	// Contradictory policies are rejected.
+	require.Panics(t, func() {
+		(&Handler{}).handle(http.NewServeMux(), config.Config{}, "GET /both", okHandler, withPublic(),
+			withRoles("admin"))
+	})
+
+	// Protected routes are rejected if no authentication is configured, since they would reject every request.
+	require.PanicsWithValue(t,
+		`route "GET /me" requires authentication, but neither jwt nor api key authentication is configured`,
+		func() {
+			(&Handler{}).handle(http.NewServeMux(), config.Config{}, "GET /me", okHandler, withAuthentication())
+		},
+	)
+
+	// The policies are described for inspection.
+	handler := newAuthHandler()
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "GET /public", okHandler, withPublic())
+	handler.handle(mux, config.Config{}, "GET /me", okHandler, withAuthentication())
+	handler.handle(mux, config.Config{}, "GET /users/{id}", okHandler, withRoles("admin", "support"),
+		withScopes("users:read"), withOwnership(func(*http.Request, *principal) (bool, error) { return true, nil }))
+
+	require.Equal(t, map[string]string{
+		"GET /public":     "public",
+		"GET /me":         "authenticated",
+		"GET /users/{id}": "roles=admin,support scopes=users:read owner",
+	}, handler.policies())
+}
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	// The caller must own the user in the path.
+	ownsUser := func(r *http.Request, caller *principal) (bool, error) {
+		if r.PathValue("id") == "broken" {
+			return false, errors.New("database unavailable")
+		}
+		return r.PathValue("id") == caller.id(), nil
+	}
+
+	handler := newAuthHandler()
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "GET /admin", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, withRoles("admin", "support"))
+	handler.handle(mux, config.Config{}, "GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, withOwnership(ownsUser))
+
+	user := &principal{claims: &jwt.Claims{Subject: "user-1"}}
+	admin := &principal{claims: &jwt.Claims{Subject: "user-2"}, roles: []string{"admin"}}
+	service := &principal{apiKey: &apikey.Key{ID: "user-1"}, roles: []string{"support"}}
+
+	testCases := []struct {
+		name         string
+		path         string
+		caller       *principal
+		expectedCode int
+	}{
+		{name: "Anonymous", path: "/admin", expectedCode: http.StatusUnauthorized},
+		{name: "Missing role", path: "/admin", caller: user, expectedCode: http.StatusForbidden},
+		{name: "Has role", path: "/admin", caller: admin, expectedCode: http.StatusOK},
+		{name: "Has other role", path: "/admin", caller: service, expectedCode: http.StatusOK},
+		{name: "Owner", path: "/users/user-1", caller: user, expectedCode: http.StatusOK},
+		{name: "Owner by API key", path: "/users/user-1", caller: service, expectedCode: http.StatusOK},
+		{name: "Not owner", path: "/users/user-1", caller: admin, expectedCode: http.StatusForbidden},
+		{name: "Ownership check fails", path: "/users/broken", caller: user, expectedCode: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io"+tc.path, nil)
+			if tc.caller != nil {
+				request = request.WithContext(context.WithValue(request.Context(), principalKey{}, tc.caller))
+			}
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -2,13 +2,24 @@ package rest
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/shivanshkc/squelette/internal/apikey"
 	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/idempotency"
+	"github.com/shivanshkc/squelette/internal/jwt"
+	"github.com/shivanshkc/squelette/internal/loadshed"
+	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/internal/ratelimit"
+	"github.com/shivanshkc/squelette/internal/webhook"
 	"github.com/shivanshkc/squelette/pkg/httputils"
+	"github.com/shivanshkc/squelette/pkg/sse"
+	"github.com/shivanshkc/squelette/pkg/websocket"
 )
 
-// maxBodyReadBytes is the max size that a request body is allowed to have.
+// maxBodyReadBytes is the max size that a request body is allowed to have, unless the route overrides it.
 const maxBodyReadBytes = 16 * 1024 // 16 KB
 
 // Handler encapsulates all REST API handlers.
@@ -16,45 +27,169 @@ const maxBodyReadBytes = 16 * 1024 // 16 KB
 // It implements the http.Handler interface for convenient usage with an http.Server.
 type Handler struct {
 	underlying http.Handler
+	// All registered routes, for inspection.
+	routes []*route
+
+	// Token buckets of the rate limiter, shared by all routes.
+	rateLimitStore ratelimit.Store
+	// Limiter of requests in flight, shared by all routes. Nil if load shedding is disabled.
+	loadLimiter *loadshed.Limiter
+	// Verifier of bearer tokens. Nil if JWT authentication is not configured.
+	jwtVerifier *jwt.Verifier
+	// Store of API keys. Nil if API key authentication is not configured.
+	apiKeyStore apikey.Store
+	// Message IDs of received webhooks, shared by all webhook routes.
+	nonceStore webhook.NonceStore
+	// Responses of requests with an Idempotency-Key, shared by all idempotent routes.
+	idempotencyStore idempotency.Store
+	// Topics of server-sent events, shared by all event stream routes.
+	sseBroker *sse.Broker
+	// Options of the websocket connections, and the hub that broadcasts to them.
+	websocketOptions websocket.Options
+	websocketHub     *websocket.Hub
+	// Upgrader of cleartext connections to HTTP/2. Nil if h2c is disabled.
+	h2cUpgrader *h2cUpgrader
 }
 
 // NewHandler returns a new Handler instance.
+//
+// It panics if the config refers to resources that cannot be loaded, like key files.
 func NewHandler(conf config.Config) *Handler {
-	handler := &Handler{}
+	handler := &Handler{
+		rateLimitStore:   ratelimit.NewMemoryStore(conf.RateLimit.MaxKeys),
+		nonceStore:       webhook.NewMemoryStore(),
+		idempotencyStore: idempotency.NewMemoryStore(time.Duration(conf.Idempotency.TTLSec) * time.Second),
+		sseBroker: sse.NewBroker(sse.BrokerOptions{
+			ReplaySize: conf.SSE.ReplaySize,
+			ReplayTTL:  time.Duration(conf.SSE.ReplayTTLSec) * time.Second,
+			Writer: sse.Options{
+				Heartbeat: time.Duration(conf.SSE.HeartbeatSec) * time.Second,
+				Retry:     time.Duration(conf.SSE.RetryMs) * time.Millisecond,
+			},
+		}),
+		websocketOptions: websocketOptions(conf),
+		websocketHub:     websocket.NewHub(),
+	}
+
+	if conf.LoadShedding.Mode != "" {
+		handler.loadLimiter = loadshed.New(loadshed.Options{
+			Adaptive:      conf.LoadShedding.Mode == "adaptive",
+			MinInFlight:   conf.LoadShedding.MinInFlight,
+			MaxInFlight:   conf.LoadShedding.MaxInFlight,
+			LatencyTarget: time.Duration(conf.LoadShedding.LatencyTargetMs) * time.Millisecond,
+			MaxQueue:      conf.LoadShedding.MaxQueue,
+			QueueTimeout:  time.Duration(conf.LoadShedding.QueueTimeoutMs) * time.Millisecond,
+		})
+	}
+
+	if conf.HttpServer.H2C {
+		handler.h2cUpgrader = newH2CUpgrader(conf)
+	}
+
+	verifier, err := newJWTVerifier(conf)
+	if err != nil {
+		panic("failed to set up jwt authentication: " + err.Error())
+	}
+	handler.jwtVerifier = verifier
+
+	if conf.Auth.APIKeys.File != "" {
+		store, err := apikey.LoadFileStore(conf.Auth.APIKeys.File)
+		if err != nil {
+			panic("failed to set up api key authentication: " + err.Error())
+		}
+		handler.apiKeyStore = store
+	}
+
+	httputils.SetProblemOptions(httputils.ProblemOptions{
+		Always:      conf.HttpServer.ProblemDetails.Always,
+		TypeBaseURI: conf.HttpServer.ProblemDetails.TypeBaseURI,
+		Extensions:  problemExtensions,
+	})
+
+	// The error codes are registered by init functions, so they are all known by now.
+	if err := httputils.CheckCatalog(conf.HttpServer.Locales...); err != nil {
+		panic("error catalog is incomplete: " + err.Error())
+	}
 
-	handler.addRoutes()
+	handler.addRoutes(conf)
 	handler.addMiddleware(conf)
 	return handler
 }
 
+// problemExtensions returns the extension members of the problem details of the request. The correlation ID lets
+// clients refer to the failed request when reporting it.
+func problemExtensions(r *http.Request) map[string]any {
+	correlationID, exists := logger.GetContextValues(r.Context())[ctxKeyCorrelationID]
+	if !exists {
+		return nil
+	}
+	return map[string]any{ctxKeyCorrelationID: correlationID.String()}
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.underlying.ServeHTTP(w, r)
 }
 
+// CloseStreams ends the event streams, so that their connections can be drained. It is meant to be registered with
+// http.Server.RegisterOnShutdown, since the server would otherwise wait for the streams until its shutdown times out.
+func (h *Handler) CloseStreams() {
+	h.sseBroker.Close()
+}
+
 // Close the handler's operations gracefully.
+//
+// The websocket and h2c connections are not tracked by the http server once they are upgraded, so they are closed
+// here. The websocket ones with a close frame, and the h2c ones once their active requests are done.
 func (h *Handler) Close(ctx context.Context) error {
-	return nil
+	h.sseBroker.Close()
+
+	var h2cErr error
+	if h.h2cUpgrader != nil {
+		h2cErr = h.h2cUpgrader.shutdown(ctx)
+	}
+	return errors.Join(h2cErr, h.websocketHub.Close(ctx))
 }
 
 // addRoutes instantiates the underlying handler and attaches all REST routes to it.
-func (h *Handler) addRoutes() {
+//
+// Routes are registered using the handle method, so they get the route-level middleware, like read/write deadlines.
+// Every route must declare its authorization policy, or the handler panics at startup.
+func (h *Handler) addRoutes(conf config.Config) {
 	// A ServeMux will act as the underlying http.Handler.
 	mux := http.NewServeMux()
 	h.underlying = mux
 
 	// Status check API.
-	mux.HandleFunc("GET /api", func(w http.ResponseWriter, r *http.Request) {
+	h.handle(mux, conf, "GET /api", func(w http.ResponseWriter, r *http.Request) {
 		httputils.WriteJson(w, http.StatusOK, nil, map[string]any{"code": "OK"})
-	})
+	}, withOperational(), withPublic())
 }
 
 // addMiddleware wraps the underlying handler with all the middleware.
 func (h *Handler) addMiddleware(conf config.Config) {
 	// Middleware attachments. This order is opposite to the execution order.
-	next := bodySizeLimitMiddleware(h.underlying, maxBodyReadBytes)
+	// The body size limit and decompression are applied by the routes, since the limit may differ per route.
+	next := h.underlying
+	if h.apiKeyStore != nil {
+		next = apiKeyMiddleware(next, h.apiKeyStore)
+	}
+	if h.jwtVerifier != nil {
+		next = authenticationMiddleware(next, h.jwtVerifier)
+	}
 	next = corsMiddleware(next, conf.HttpServer.AllowedOrigins, conf.HttpServer.CorsMaxAgeSec)
+	if conf.HttpServer.Compression.Enabled {
+		next = compressionMiddleware(next, conf.HttpServer.Compression.MinSizeBytes)
+	}
 	next = accessLoggerMiddleware(next)
+	next = deadlineMiddleware(next,
+		time.Duration(conf.HttpServer.RouteReadTimeoutSec)*time.Second,
+		time.Duration(conf.HttpServer.RouteWriteTimeoutSec)*time.Second,
+	)
 	next = recoveryMiddleware(next) // <- This will execute first.
+	if h.h2cUpgrader != nil {
+		// Except for the h2c upgrade, since upgraded connections are served by the whole chain again, over HTTP/2.
+		next = h.h2cUpgrader.middleware(next)
+	}
 
 	h.underlying = next
 }
@@ -0,0 +1,228 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/ratelimit"
+)
+
+// defaultRateLimitGroup is the rate limit group of routes that do not specify one.
+const defaultRateLimitGroup = "default"
+
+// route is a single REST route along with the settings that apply to it alone.
+type route struct {
+	pattern string
+	handler http.Handler
+
+	// Streaming routes (SSE, websockets, large downloads etc.) are exempt from the read and write deadlines.
+	streaming bool
+	// Overrides for the default read and write deadlines from the config. Zero means no override.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// Override for the default request context deadline from the config. Zero means no override.
+	requestTimeout time.Duration
+
+	// Max size of the request body, both encoded and decoded. Zero means the default maxBodyReadBytes.
+	bodyLimit int64
+	// Upload routes read the body as it arrives. They get a 413 as soon as it exceeds the limit, and are exempt from
+	// the read deadline and the request timeout unless they override them. Their write deadline starts once the body
+	// is read.
+	upload bool
+
+	// Operational routes (health checks, admin etc.) are exempt from rate limiting and load shedding.
+	operational bool
+	// Name of the rate limit group from the config that the route belongs to.
+	rateLimitGroup string
+
+	// Who is allowed to call the route.
+	policy policy
+	// Idempotent routes store and replay the responses of requests with an Idempotency-Key.
+	idempotent bool
+}
+
+// routeOption customizes a route at registration time.
+type routeOption func(*route)
+
+// withStreaming marks the route as long-lived, like SSE or websockets. Such routes are exempt from the deadlines, the
+// request timeout and load shedding.
+func withStreaming() routeOption {
+	return func(rt *route) { rt.streaming = true }
+}
+
+// withTimeouts overrides the default read and write deadlines for the route. A zero value keeps the default.
+func withTimeouts(read, write time.Duration) routeOption {
+	return func(rt *route) {
+		rt.readTimeout = read
+		rt.writeTimeout = write
+	}
+}
+
+// withRequestTimeout overrides the default request timeout for the route. It must be shorter than the route's write
+// deadline, so that the timeout response can still be written.
+func withRequestTimeout(timeout time.Duration) routeOption {
+	return func(rt *route) { rt.requestTimeout = timeout }
+}
+
+// withBodyLimit overrides the default max size of the request body for the route.
+func withBodyLimit(maxBytes int64) routeOption {
+	return func(rt *route) { rt.bodyLimit = maxBytes }
+}
+
+// withStreamingUpload marks the route as an upload that reads the body as it arrives, with the given max size. The
+// client gets a 413 as soon as the body exceeds it. Since uploads take as long as the client's bandwidth requires,
+// such routes are exempt from the default read deadline and request timeout, but they may still set their own. The
+// write deadline only starts once the body is read.
+func withStreamingUpload(maxBytes int64) routeOption {
+	return func(rt *route) {
+		rt.bodyLimit = maxBytes
+		rt.upload = true
+	}
+}
+
+// withOptions combines the given options into one. It allows groups of routes to share their settings.
+func withOptions(options ...routeOption) routeOption {
+	return func(rt *route) {
+		for _, option := range options {
+			option(rt)
+		}
+	}
+}
+
+// withOperational marks the route as operational, like health checks and admin routes. Such routes are exempt from
+// rate limiting and load shedding, so they keep working under heavy traffic.
+func withOperational() routeOption {
+	return func(rt *route) { rt.operational = true }
+}
+
+// withRateLimitGroup puts the route in the given rate limit group, instead of the default one. The group must be
+// present in the config.
+func withRateLimitGroup(group string) routeOption {
+	return func(rt *route) { rt.rateLimitGroup = group }
+}
+
+// withIdempotency makes the route honor the Idempotency-Key header of POST and PATCH requests, so that clients can
+// safely retry them.
+func withIdempotency() routeOption {
+	return func(rt *route) { rt.idempotent = true }
+}
+
+// handle registers the given handler on the mux along with the route-level middleware.
+func (h *Handler) handle(mux *http.ServeMux, conf config.Config, pattern string, handler http.HandlerFunc,
+	options ...routeOption,
+) {
+	rt := &route{pattern: pattern, handler: handler, rateLimitGroup: defaultRateLimitGroup}
+	for _, option := range options {
+		option(rt)
+	}
+
+	// An invalid route panics before it is registered, so the registered routes are always valid.
+	h.checkPolicy(rt)
+	wrapped := h.wrap(rt, conf)
+
+	h.routes = append(h.routes, rt)
+	mux.Handle(pattern, wrapped)
+}
+
+// wrap returns the route's handler wrapped with the route-level middleware.
+//
+// It panics if the route refers to settings that are absent from the config, or if its request timeout is not shorter
+// than its write deadline, so mistakes are caught at startup.
+func (h *Handler) wrap(rt *route, conf config.Config) http.Handler {
+	next := rt.handler
+
+	// The request timeout cannot be applied at the handler level, since a route can only shorten a context deadline,
+	// never extend it.
+	requestTimeout := time.Duration(conf.HttpServer.RequestTimeoutSec) * time.Second
+	if rt.upload {
+		requestTimeout = 0
+	}
+	if rt.requestTimeout > 0 {
+		requestTimeout = rt.requestTimeout
+	}
+
+	writeTimeout := time.Duration(conf.HttpServer.RouteWriteTimeoutSec) * time.Second
+	if rt.writeTimeout > 0 {
+		writeTimeout = rt.writeTimeout
+	}
+	// Otherwise, the connection would be broken by the write deadline before the timeout response is written.
+	// Uploads are exempt, since their write deadline only starts once the body is read.
+	if !rt.streaming && !rt.upload && requestTimeout > 0 && writeTimeout > 0 && requestTimeout >= writeTimeout {
+		panic(fmt.Sprintf("route %q has a request timeout of %s that is not shorter than its write timeout of %s",
+			rt.pattern, requestTimeout, writeTimeout))
+	}
+
+	if !rt.streaming && requestTimeout > 0 {
+		next = timeoutMiddleware(next, requestTimeout)
+	}
+
+	// The default deadlines are applied to all requests by the handler-level middleware.
+	// They only need to be reapplied here if the route is exempt or overrides them.
+	var uploadWriteTimeout time.Duration
+	switch {
+	case rt.streaming:
+		next = deadlineMiddleware(next, 0, 0)
+	case rt.upload || rt.readTimeout > 0 || rt.writeTimeout > 0:
+		readTimeout := time.Duration(conf.HttpServer.RouteReadTimeoutSec) * time.Second
+		if rt.upload {
+			readTimeout = 0
+		}
+		if rt.readTimeout > 0 {
+			readTimeout = rt.readTimeout
+		}
+
+		// The write deadline of uploads is cleared here, and started by the upload middleware once the body is read.
+		if rt.upload {
+			uploadWriteTimeout, writeTimeout = writeTimeout, 0
+		}
+
+		next = deadlineMiddleware(next, readTimeout, writeTimeout)
+	}
+
+	// Long-lived requests would hold their slots indefinitely, so streaming routes are exempt.
+	if h.loadLimiter != nil && !rt.operational && !rt.streaming {
+		retryAfter := strconv.Itoa(conf.LoadShedding.RetryAfterSec)
+		next = loadSheddingMiddleware(next, h.loadLimiter, retryAfter)
+	}
+
+	// Replays skip load shedding, since they are cheap. They come after authorization though, so that anonymous
+	// clients cannot probe the stored responses.
+	if rt.idempotent {
+		next = idempotencyMiddleware(next, h.idempotencyStore, conf.RateLimit.TrustForwardedFor)
+	}
+
+	if !rt.policy.public && rt.policy.webhook == "" {
+		next = authorizationMiddleware(next, rt.policy)
+	}
+
+	// The body is limited before anything reads it, like the webhook signature verification.
+	bodyLimit := int64(maxBodyReadBytes)
+	if rt.bodyLimit > 0 {
+		bodyLimit = rt.bodyLimit
+	}
+	if rt.upload {
+		next = uploadLimitMiddleware(next, uploadWriteTimeout)
+	}
+	next = decompressionMiddleware(next, bodyLimit)
+	// Webhook signatures cover the body as sent, so they are verified before it is decoded.
+	if rt.policy.webhook != "" {
+		next = webhookMiddleware(next, h.newWebhookVerifier(rt, conf))
+	}
+	next = bodySizeLimitMiddleware(next, bodyLimit)
+
+	// Rate limiting comes first, so rejected requests are as cheap as possible.
+	group, exists := conf.RateLimit.Groups[rt.rateLimitGroup]
+	if !exists && rt.rateLimitGroup != defaultRateLimitGroup {
+		panic(fmt.Sprintf("route %q uses rate limit group %q that is absent from the config", rt.pattern,
+			rt.rateLimitGroup))
+	}
+	if exists && !rt.operational {
+		limit := ratelimit.Limit{Rate: group.RequestsPerSec, Burst: group.Burst}
+		next = rateLimitMiddleware(next, h.rateLimitStore, rt.rateLimitGroup, limit, conf.RateLimit.TrustForwardedFor)
+	}
+
+	return next
+}
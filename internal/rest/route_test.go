@@ -0,0 +1,246 @@
+package rest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/internal/ratelimit"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteDeadlines(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	// The default deadlines are generous. The routes below override them. There is no request timeout, since it
+	// would have to be shorter than the write deadline of the routes.
+	conf := config.Config{}
+	conf.HttpServer.RouteReadTimeoutSec = 60
+	conf.HttpServer.RouteWriteTimeoutSec = 60
+
+	// Mock handler that responds only after the write deadline has passed.
+	slowHandler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}
+
+	handler := &Handler{}
+	mux := http.NewServeMux()
+	handler.handle(mux, conf, "GET /normal", slowHandler, withTimeouts(0, 50*time.Millisecond), withPublic())
+	handler.handle(mux, conf, "GET /streaming", slowHandler, withTimeouts(0, 50*time.Millisecond), withStreaming(),
+		withPublic())
+	require.Len(t, handler.routes, 2)
+
+	// The access logger wraps the writer, so this also verifies that the deadlines reach the connection through it.
+	server := httptest.NewServer(deadlineMiddleware(accessLoggerMiddleware(mux), 60*time.Second, 60*time.Second))
+	defer server.Close()
+
+	// The normal route misses its write deadline, so the connection is broken before the response is sent.
+	response, err := http.Get(server.URL + "/normal")
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		_ = response.Body.Close()
+	}
+	require.Error(t, err)
+
+	// The streaming route is exempt from deadlines.
+	response, err = http.Get(server.URL + "/streaming")
+	require.NoError(t, err)
+	defer func() { _ = response.Body.Close() }()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, "done", string(body))
+}
+
+func TestRouteRequestTimeout(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	// The default timeout is generous. The route below overrides it.
+	conf := config.Config{}
+	conf.HttpServer.RequestTimeoutSec = 60
+
+	// Mock handler that respects the context.
+	handler := &Handler{}
+	mux := http.NewServeMux()
+	handler.handle(mux, conf, "GET /api", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}, withRequestTimeout(50*time.Millisecond), withPublic())
+
+	request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io/api", nil)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	// A request timeout that is not shorter than the write deadline is caught at registration.
+	conf.HttpServer.RouteWriteTimeoutSec = 30
+	require.Panics(t, func() {
+		handler.handle(http.NewServeMux(), conf, "GET /slow", nil, withRequestTimeout(time.Minute), withPublic())
+	})
+	require.NotPanics(t, func() {
+		handler.handle(http.NewServeMux(), conf, "GET /slow", nil, withTimeouts(0, 2*time.Minute),
+			withRequestTimeout(time.Minute), withPublic())
+	})
+}
+
+func TestRouteRateLimitGroups(t *testing.T) {
+	conf := config.Config{}
+	conf.RateLimit.Groups = map[string]config.RateLimitGroup{
+		"default": {RequestsPerSec: 0.001, Burst: 1},
+		"uploads": {RequestsPerSec: 0.001, Burst: 2},
+	}
+
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	handler := &Handler{rateLimitStore: ratelimit.NewMemoryStore(100)}
+	mux := http.NewServeMux()
+	handler.handle(mux, conf, "GET /default", okHandler, withPublic())
+	handler.handle(mux, conf, "GET /uploads", okHandler, withRateLimitGroup("uploads"), withPublic())
+	handler.handle(mux, conf, "GET /health", okHandler, withOperational(), withPublic())
+
+	// Convenience function to call the given path and return the response code.
+	call := func(path string) int {
+		request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io"+path, nil)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// Each group has its own buckets.
+	require.Equal(t, http.StatusOK, call("/default"))
+	require.Equal(t, http.StatusTooManyRequests, call("/default"))
+	require.Equal(t, http.StatusOK, call("/uploads"))
+	require.Equal(t, http.StatusOK, call("/uploads"))
+	require.Equal(t, http.StatusTooManyRequests, call("/uploads"))
+
+	// Operational routes are never limited.
+	for range 5 {
+		require.Equal(t, http.StatusOK, call("/health"))
+	}
+
+	// Unknown groups are caught at registration.
+	require.Panics(t, func() {
+		handler.handle(http.NewServeMux(), conf, "GET /unknown", okHandler, withRateLimitGroup("unknown"), withPublic())
+	})
+}
+
+func TestRouteBodyLimits(t *testing.T) {
+	// Mock handler that buffers the body, as most routes do.
+	buffered := func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := bufferBody(w, r); ok {
+			_, _ = w.Write([]byte(strconv.Itoa(len(body))))
+		}
+	}
+
+	// Mock handler that reads the body as it arrives, and fails on its own if reading fails.
+	streamed := func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(int(n))))
+	}
+
+	// Routes of a group share their options.
+	uploads := withOptions(withStreamingUpload(64*1024), withPublic())
+
+	handler := &Handler{}
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "POST /default", buffered, withPublic())
+	handler.handle(mux, config.Config{}, "POST /large", buffered, withBodyLimit(32*1024), withPublic())
+	handler.handle(mux, config.Config{}, "POST /upload", streamed, uploads)
+
+	// Convenience function to send a body of the given size. Bodies of unknown length are sent without a
+	// Content-Length, so that the limit is only caught while reading.
+	send := func(path string, size int, knownLength bool) *httptest.ResponseRecorder {
+		var body io.Reader = bytes.NewReader(bytes.Repeat([]byte{'x'}, size))
+		if !knownLength {
+			body = io.MultiReader(body)
+		}
+
+		request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io"+path, body)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	testCases := []struct {
+		name         string
+		path         string
+		size         int
+		knownLength  bool
+		expectedCode int
+	}{
+		{name: "Default limit", path: "/default", size: 1024, knownLength: true, expectedCode: http.StatusOK},
+		{name: "Over default limit", path: "/default", size: 20 * 1024, knownLength: true,
+			expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Over default limit while reading", path: "/default", size: 20 * 1024,
+			expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Route limit", path: "/large", size: 20 * 1024, knownLength: true, expectedCode: http.StatusOK},
+		{name: "Upload", path: "/upload", size: 60 * 1024, expectedCode: http.StatusOK},
+		{name: "Upload over limit", path: "/upload", size: 100 * 1024, expectedCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := send(tc.path, tc.size, tc.knownLength)
+			require.Equal(t, tc.expectedCode, recorder.Code)
+			if tc.expectedCode == http.StatusOK {
+				require.Equal(t, strconv.Itoa(tc.size), recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouteUploadWriteDeadline(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	// Mock handler that reads the upload in full before responding.
+	streamed := func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(int(n))))
+	}
+
+	handler := &Handler{}
+	mux := http.NewServeMux()
+	handler.handle(mux, config.Config{}, "POST /upload", streamed, withStreamingUpload(64*1024),
+		withTimeouts(0, 100*time.Millisecond), withPublic())
+
+	server := httptest.NewServer(deadlineMiddleware(accessLoggerMiddleware(mux), 60*time.Second, 60*time.Second))
+	defer server.Close()
+
+	// The client sends the body slowly, so the upload outlasts the write timeout of the route.
+	reader, writer := io.Pipe()
+	go func() {
+		for range 3 {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = writer.Write(bytes.Repeat([]byte{'x'}, 1024))
+		}
+		_ = writer.Close()
+	}()
+
+	response, err := http.Post(server.URL+"/upload", "application/octet-stream", reader)
+	require.NoError(t, err)
+	defer func() { _ = response.Body.Close() }()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "3072", string(body))
+}
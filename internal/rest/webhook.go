@@ -0,0 +1,74 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/webhook"
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+// newWebhookVerifier returns the signature verifier of the webhook that the route receives.
+//
+// It panics if the webhook is absent from the config, so mistakes are caught at startup.
+func (h *Handler) newWebhookVerifier(rt *route, conf config.Config) *webhook.Verifier {
+	webhookConf, exists := conf.Auth.Webhooks[rt.policy.webhook]
+	if !exists {
+		panic(fmt.Sprintf("route %q receives webhook %q that is absent from the config", rt.pattern,
+			rt.policy.webhook))
+	}
+
+	tolerance := time.Duration(webhookConf.ToleranceSec) * time.Second
+	verifier, err := webhook.NewVerifier(rt.policy.webhook, webhookConf.Secrets, tolerance, h.nonceStore)
+	if err != nil {
+		panic(fmt.Sprintf("route %q receives webhook %q with invalid secrets: %s", rt.pattern, rt.policy.webhook, err))
+	}
+	return verifier
+}
+
+// webhookMiddleware wraps the given http.Handler to reject requests that are not correctly signed, or are replays.
+//
+// The signature covers the raw body, so the body is buffered in full, within the limit of the body size middleware.
+// It must run before the decompression middleware, since the signature covers the body as sent, not as decoded.
+//
+// If the handler fails with a 5xx or a panic, the message ID is forgotten, so that the sender's retry is accepted.
+func webhookMiddleware(next http.Handler, verifier *webhook.Verifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bufferBody(w, r)
+		if !ok {
+			return
+		}
+
+		err := verifier.Verify(r.Context(), r.Header, body)
+		switch {
+		case errors.Is(err, webhook.ErrMissingHeaders), errors.Is(err, webhook.ErrTimestamp),
+			errors.Is(err, webhook.ErrInvalidSignature), errors.Is(err, webhook.ErrReplayed):
+			// The verification errors do not reveal anything about the secrets, so they are safe to show.
+			httputils.WriteErrorFor(w, r, httputils.Unauthorized().WithReasonStr(err.Error()).WithCause(err))
+			return
+		case err != nil:
+			httputils.WriteErrorFor(w, r, fmt.Errorf("failed to verify webhook: %w", err))
+			return
+		}
+
+		recorder := &httputils.ResponseWriterWithCode{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed && recorder.StatusCode < http.StatusInternalServerError {
+				return
+			}
+			// The request context may be canceled already, but the message ID must still be forgotten.
+			if err := verifier.Forget(context.WithoutCancel(r.Context()), r.Header); err != nil {
+				slog.ErrorContext(r.Context(), "failed to forget webhook message", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteWithWebhook(t *testing.T) {
+	secret := "partner-secret"
+
+	conf := config.Config{}
+	conf.Auth.Webhooks = map[string]config.Webhook{"partner": {Secrets: []string{secret}, ToleranceSec: 300}}
+
+	// Mock handler that echoes the body, to verify that it is given back.
+	handler := &Handler{nonceStore: webhook.NewMemoryStore()}
+	mux := http.NewServeMux()
+	handler.handle(mux, conf, "POST /webhooks/partner", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == `{"event":"failing"}` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(body)
+	}, withWebhook("partner"))
+	require.Equal(t, map[string]string{"POST /webhooks/partner": "webhook=partner"}, handler.policies())
+
+	// Same order as the real handler.
+	server := bodySizeLimitMiddleware(mux, 64)
+
+	// Convenience function to send a webhook and return the response.
+	send := func(id, body, signingSecret string) *httptest.ResponseRecorder {
+		now := time.Now()
+		request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io/webhooks/partner",
+			strings.NewReader(body))
+		request.Header.Set(webhook.HeaderID, id)
+		request.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+		request.Header.Set(webhook.HeaderSignature, webhook.Sign([]byte(signingSecret), id, now, []byte(body)))
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// A signed request reaches the handler with its body intact.
+	recorder := send("msg-1", `{"event":"paid"}`, secret)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, `{"event":"paid"}`, recorder.Body.String())
+
+	// Replays, bad signatures and oversized bodies are rejected.
+	require.Equal(t, http.StatusUnauthorized, send("msg-1", `{"event":"paid"}`, secret).Code)
+	require.Equal(t, http.StatusUnauthorized, send("msg-2", `{"event":"paid"}`, "wrong-secret").Code)
+	require.Equal(t, http.StatusRequestEntityTooLarge, send("msg-3", strings.Repeat("x", 100), secret).Code)
+
+	// A message that failed to be processed can be retried with the same ID.
+	require.Equal(t, http.StatusInternalServerError, send("msg-6", `{"event":"failing"}`, secret).Code)
+	require.Equal(t, http.StatusOK, send("msg-6", `{"event":"paid"}`, secret).Code)
+	require.Equal(t, http.StatusUnauthorized, send("msg-6", `{"event":"paid"}`, secret).Code)
+
+	// The signature covers the body as sent, so compressed bodies are verified before they are decoded.
+	sendGzip := func(id string, signDecoded bool) *httptest.ResponseRecorder {
+		decoded := []byte(`{"event":"refunded"}`)
+		var encoded bytes.Buffer
+		gzipWriter := gzip.NewWriter(&encoded)
+		_, _ = gzipWriter.Write(decoded)
+		_ = gzipWriter.Close()
+
+		signed := encoded.Bytes()
+		if signDecoded {
+			signed = decoded
+		}
+
+		now := time.Now()
+		request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io/webhooks/partner",
+			bytes.NewReader(encoded.Bytes()))
+		request.Header.Set("Content-Encoding", "gzip")
+		request.Header.Set(webhook.HeaderID, id)
+		request.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+		request.Header.Set(webhook.HeaderSignature, webhook.Sign([]byte(secret), id, now, signed))
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder = sendGzip("msg-4", false)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, `{"event":"refunded"}`, recorder.Body.String())
+	require.Equal(t, http.StatusUnauthorized, sendGzip("msg-5", true).Code)
+
+	// Unknown webhooks are caught at startup.
+	require.Panics(t, func() {
+		handler.handle(http.NewServeMux(), conf, "POST /webhooks/unknown", nil, withWebhook("unknown"))
+	})
+}
@@ -0,0 +1,29 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/pkg/websocket"
+)
+
+// websocketOptions returns the options of the websocket connections, as per the config.
+//
+// Browsers let any page open a websocket to any host, and the CORS policy does not apply to them, so the origins are
+// checked against the CORS allowed origins instead. Requests without an Origin header, like those of non-browser
+// clients, are accepted, as they are by the CORS middleware.
+func websocketOptions(conf config.Config) websocket.Options {
+	isOriginAllowed := originMatcher(conf.HttpServer.AllowedOrigins)
+
+	return websocket.Options{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || isOriginAllowed(origin)
+		},
+		MaxMessageSize: conf.WebSocket.MaxMessageBytes,
+		PingInterval:   time.Duration(conf.WebSocket.PingIntervalSec) * time.Second,
+		PongTimeout:    time.Duration(conf.WebSocket.PongTimeoutSec) * time.Second,
+		WriteTimeout:   time.Duration(conf.WebSocket.WriteTimeoutSec) * time.Second,
+	}
+}
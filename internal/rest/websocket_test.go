@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shivanshkc/squelette/internal/config"
+	"github.com/shivanshkc/squelette/internal/logger"
+	"github.com/shivanshkc/squelette/pkg/websocket"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketOptions_CheckOrigin(t *testing.T) {
+	conf := config.Config{}
+	conf.HttpServer.AllowedOrigins = []string{"https://app.squelette.shivansh.io"}
+
+	testCases := []struct {
+		name     string
+		origin   string
+		expected bool
+	}{
+		{name: "No origin", origin: "", expected: true},
+		{name: "Allowed origin", origin: "https://app.squelette.shivansh.io", expected: true},
+		{name: "Other origin", origin: "https://evil.example.com", expected: false},
+	}
+
+	checkOrigin := websocketOptions(conf).CheckOrigin
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "https://squelette.shivansh.io/api/ws", nil)
+			if tc.origin != "" {
+				request.Header.Set("Origin", tc.origin)
+			}
+			require.Equal(t, tc.expected, checkOrigin(request))
+		})
+	}
+}
+
+func TestWebsocketRoute(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logger.Init(&bytes.Buffer{}, "info", true)
+
+	conf := config.Config{}
+	conf.HttpServer.AllowedOrigins = []string{"*"}
+	conf.HttpServer.RouteReadTimeoutSec = 60
+	conf.HttpServer.RouteWriteTimeoutSec = 60
+	conf.HttpServer.RequestTimeoutSec = 30
+	conf.HttpServer.Compression.Enabled = true
+
+	handler := &Handler{websocketOptions: websocketOptions(conf)}
+	mux := http.NewServeMux()
+	handler.handle(mux, conf, "GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, handler.websocketOptions)
+		if err != nil {
+			return
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMessage(messageType, data)
+		_ = conn.Close(websocket.CloseNormal, "")
+	}, withStreaming(), withPublic())
+
+	// The connection is hijacked through all the middleware that wrap the response writer.
+	handler.underlying = mux
+	handler.addMiddleware(conf)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: squelette.shivansh.io\r\nAccept-Encoding: gzip\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	// A masked text frame with "hi", echoed back unmasked.
+	_, err = conn.Write([]byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2})
+	require.NoError(t, err)
+
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(reader, echo)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x81, 2, 'h', 'i'}, echo)
+}
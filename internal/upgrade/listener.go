@@ -0,0 +1,64 @@
+package upgrade
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener wraps a net.Listener so that it can stop accepting connections without closing the socket, which is shared
+// with the new process after an upgrade.
+//
+// This is needed because http.Server.Shutdown drops connections that were accepted but whose first request was not
+// read yet. Stopping the accepts a little before the shutdown gives such connections the time to be served.
+type Listener struct {
+	net.Listener
+
+	stopped   chan struct{}
+	closed    chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// Wrap wraps all the given listeners.
+func Wrap(listeners []net.Listener) []*Listener {
+	wrapped := make([]*Listener, 0, len(listeners))
+	for _, l := range listeners {
+		wrapped = append(wrapped, &Listener{Listener: l, stopped: make(chan struct{}), closed: make(chan struct{})})
+	}
+	return wrapped
+}
+
+// Accept waits for and returns the next connection.
+// Once the listener is stopped, it blocks until the listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	select {
+	case <-l.stopped:
+		// A connection that made it through just before the stop is still served.
+		if err == nil {
+			return conn, nil
+		}
+		<-l.closed
+		return nil, net.ErrClosed
+	default:
+		return conn, err
+	}
+}
+
+// Close closes the listener. Any blocked Accept calls are unblocked.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// stop makes the listener stop accepting new connections. The socket stays open.
+func (l *Listener) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+		// Unblock any ongoing Accept call.
+		if d, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+			_ = d.SetDeadline(time.Now())
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// Package upgrade implements zero-downtime binary upgrades.
+//
+// The running process (parent) starts a new copy of its own binary (child) and hands it the open listening sockets.
+// Once the child reports that it is ready, the parent stops accepting connections and drains the in-flight requests.
+// Since the sockets are never closed, the kernel keeps queueing connections throughout and none are dropped.
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// envListenFDs holds the number of listeners handed over to the child.
+	// They occupy the file descriptors starting at 3, in order.
+	envListenFDs = "SQUELETTE_UPGRADE_LISTEN_FDS"
+	// envReadyFD holds the file descriptor that the child must close after writing a byte to it, once it is ready.
+	envReadyFD = "SQUELETTE_UPGRADE_READY_FD"
+
+	// The first extra file descriptor of a child process. 0, 1 and 2 are stdin, stdout and stderr.
+	extraFilesStart = 3
+
+	// readyTimeout is how long the parent waits for the child to become ready before giving up on the upgrade.
+	readyTimeout = 30 * time.Second
+	// stopGracePeriod is how long the parent waits after it stops accepting connections, so the connections that were
+	// accepted just before have their first request read before the shutdown begins.
+	stopGracePeriod = time.Second
+)
+
+// Inherited returns the listeners handed over by the parent process.
+// If this process was not started by an upgrade, it returns nil and no error.
+func Inherited() ([]net.Listener, error) {
+	value, found := os.LookupEnv(envListenFDs)
+	if !found {
+		return nil, nil
+	}
+	// Do not pass these on to any other process.
+	_ = os.Unsetenv(envListenFDs)
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid %s value: %q", envListenFDs, value)
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := range count {
+		file := os.NewFile(uintptr(extraFilesStart+i), "inherited-listener-"+strconv.Itoa(i))
+		l, err := net.FileListener(file)
+		// FileListener duplicates the descriptor, so the original is no longer required.
+		_ = file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("failed to use inherited listener %d: %w", i, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// Ready notifies the parent process that this process is ready to serve, so the parent can start draining.
+// It is a no-op if this process was not started by an upgrade.
+func Ready() error {
+	value, found := os.LookupEnv(envReadyFD)
+	if !found {
+		return nil
+	}
+	_ = os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s value: %q", envReadyFD, value)
+	}
+
+	file := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer func() { _ = file.Close() }()
+
+	if _, err := file.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to notify the parent process: %w", err)
+	}
+	return nil
+}
+
+// Start starts a new copy of the running binary with the same arguments, hands it the given listeners, and waits
+// until it reports ready.
+//
+// If it returns nil, the listeners have stopped accepting connections and the caller must exit gracefully. If it
+// returns an error, the new process has been killed and the caller should keep serving as before.
+func Start(ctx context.Context, listeners []*Listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the executable: %w", err)
+	}
+
+	// Duplicate the listening sockets so they can be passed to the child.
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be handed over", l.Addr())
+		}
+
+		file, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to get the file of listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, file)
+	}
+
+	// The child reports readiness through this pipe.
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the ready pipe: %w", err)
+	}
+	defer func() { _ = readyReader.Close() }()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+strconv.Itoa(len(listeners)),
+		envReadyFD+"="+strconv.Itoa(extraFilesStart+len(listeners)),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the new process: %w", err)
+	}
+
+	// Only the child must hold the write end, otherwise the read below never sees EOF if the child dies.
+	_ = readyWriter.Close()
+	files = files[:len(files)-1]
+
+	if err := waitReady(ctx, readyReader); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	for _, l := range listeners {
+		// Closing a Unix listener removes its socket file by default, which would pull the socket from under the child.
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		// From now on, only the child accepts connections.
+		l.stop()
+	}
+
+	time.Sleep(stopGracePeriod)
+	return nil
+}
+
+// waitReady blocks until the child writes to the ready pipe, the child exits, the timeout elapses or the context is
+// canceled.
+func waitReady(ctx context.Context, readyReader *os.File) error {
+	_ = readyReader.SetReadDeadline(time.Now().Add(readyTimeout))
+
+	// Unblock the read if the context is canceled.
+	stop := context.AfterFunc(ctx, func() { _ = readyReader.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	n, err := readyReader.Read(make([]byte, 1))
+	switch {
+	case n == 1:
+		return nil
+	case ctx.Err() != nil:
+		return fmt.Errorf("upgrade canceled: %w", ctx.Err())
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return errors.New("the new process did not become ready in time")
+	default:
+		return fmt.Errorf("the new process exited before becoming ready: %w", err)
+	}
+}
@@ -0,0 +1,219 @@
+package upgrade
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// envTestChild tells the test binary that it was started by Start, and how the child process must behave.
+const envTestChild = "SQUELETTE_UPGRADE_TEST_CHILD"
+
+// TestMain runs the child process behaviors, since Start runs the test binary again as the new process.
+func TestMain(m *testing.M) {
+	switch os.Getenv(envTestChild) {
+	case "serve":
+		if err := serveChild(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "crash":
+		os.Exit(1)
+	case "inherit":
+		// The parent checks the error.
+		_, err := Inherited()
+		fmt.Print(err)
+		os.Exit(0)
+	default:
+		os.Exit(m.Run())
+	}
+}
+
+// serveChild takes over the inherited listeners, reports ready, and answers one connection on each of them.
+func serveChild() error {
+	listeners, err := Inherited()
+	if err != nil {
+		return err
+	}
+	if _, found := os.LookupEnv(envListenFDs); found {
+		return errors.New("listener count was passed on")
+	}
+	if err := Ready(); err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		// Do not linger if the parent fails before connecting.
+		_ = l.(interface{ SetDeadline(time.Time) error }).SetDeadline(time.Now().Add(10 * time.Second))
+
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Write([]byte("child " + strconv.Itoa(os.Getpid()) + "\n"))
+		_ = conn.Close()
+		_ = l.Close()
+	}
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	// This test cannot run in parallel because it relies on the environment of the process.
+	t.Setenv(envTestChild, "serve")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "api.sock"))
+	require.NoError(t, err)
+
+	listeners := Wrap([]net.Listener{tcp, unix})
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+
+	require.NoError(t, Start(context.Background(), listeners))
+
+	for _, l := range listeners {
+		// The parent no longer accepts connections.
+		select {
+		case <-l.stopped:
+		default:
+			t.Fatalf("listener %s was not stopped", l.Addr())
+		}
+
+		// The child serves on the same sockets, including the Unix one that the parent will close.
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(line, "child "), line)
+		require.NotEqual(t, "child "+strconv.Itoa(os.Getpid())+"\n", line)
+	}
+}
+
+func TestStart_ChildCrashes(t *testing.T) {
+	// This test cannot run in parallel because it relies on the environment of the process.
+	t.Setenv(envTestChild, "crash")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	listeners := Wrap([]net.Listener{tcp})
+	defer func() { _ = listeners[0].Close() }()
+
+	err = Start(context.Background(), listeners)
+	require.ErrorContains(t, err, "the new process exited before becoming ready")
+
+	// The parent keeps serving.
+	go func() {
+		conn, err := net.Dial("tcp", tcp.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := listeners[0].Accept()
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestInherited(t *testing.T) {
+	testCases := []struct {
+		name          string
+		value         string
+		errorContains string
+	}{
+		{name: "Not a number", value: "two", errorContains: `invalid ` + envListenFDs + ` value: "two"`},
+		{name: "Zero", value: "0", errorContains: `invalid ` + envListenFDs + ` value: "0"`},
+		{name: "Negative", value: "-1", errorContains: `invalid ` + envListenFDs + ` value: "-1"`},
+		{name: "Empty", value: "", errorContains: `invalid ` + envListenFDs + ` value: ""`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// This test cannot run in parallel because it relies on the environment of the process.
+			t.Setenv(envListenFDs, tc.value)
+
+			listeners, err := Inherited()
+			require.ErrorContains(t, err, tc.errorContains)
+			require.Nil(t, listeners)
+
+			// The value is not passed on to any other process, even if it is invalid.
+			_, found := os.LookupEnv(envListenFDs)
+			require.False(t, found)
+		})
+	}
+
+	t.Run("Not upgraded", func(t *testing.T) {
+		listeners, err := Inherited()
+		require.NoError(t, err)
+		require.Nil(t, listeners)
+	})
+
+	t.Run("Not a socket", func(t *testing.T) {
+		// The descriptors are closed by Inherited, so this runs in a child process that gets a regular file instead.
+		file, err := os.Open(os.Args[0])
+		require.NoError(t, err)
+		defer func() { _ = file.Close() }()
+
+		cmd := exec.Command(os.Args[0])
+		cmd.ExtraFiles = []*os.File{file}
+		cmd.Env = append(os.Environ(), envTestChild+"=inherit", envListenFDs+"=1")
+
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+		require.Contains(t, string(output), "failed to use inherited listener 0")
+	})
+}
+
+func TestReady(t *testing.T) {
+	t.Run("Not upgraded", func(t *testing.T) {
+		require.NoError(t, Ready())
+	})
+
+	t.Run("Invalid value", func(t *testing.T) {
+		// This test cannot run in parallel because it relies on the environment of the process.
+		t.Setenv(envReadyFD, "pipe")
+		require.ErrorContains(t, Ready(), `invalid `+envReadyFD+` value: "pipe"`)
+	})
+
+	t.Run("Notifies the parent", func(t *testing.T) {
+		reader, writer, err := os.Pipe()
+		require.NoError(t, err)
+		defer func() { _ = reader.Close() }()
+
+		// Ready closes the descriptor, so it gets a copy that is not owned by any *os.File.
+		fd, err := syscall.Dup(int(writer.Fd()))
+		require.NoError(t, err)
+		_ = writer.Close()
+
+		// This test cannot run in parallel because it relies on the environment of the process.
+		t.Setenv(envReadyFD, strconv.Itoa(fd))
+		require.NoError(t, Ready())
+
+		// The byte is followed by EOF, since the only write end is closed.
+		content := make([]byte, 2)
+		n, err := reader.Read(content)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, content[:n])
+		_, err = reader.Read(content)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,220 @@
+// Package webhook verifies signed webhook requests, following the Standard Webhooks specification.
+//
+// A request carries three headers: a unique message ID, a Unix timestamp, and one or more signatures. Each signature is
+// "v1," followed by the base64 HMAC-SHA256 of "<id>.<timestamp>.<body>". Requests are rejected if their timestamp is
+// outside the tolerated window, or if their message ID was seen before, so captured requests cannot be replayed.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request.
+const (
+	HeaderID        = "Webhook-Id"
+	HeaderTimestamp = "Webhook-Timestamp"
+	HeaderSignature = "Webhook-Signature"
+)
+
+// secretPrefix marks base64-encoded secrets, as issued by Standard Webhooks providers.
+const secretPrefix = "whsec_"
+
+var (
+	// ErrMissingHeaders is returned when any of the signature headers is absent.
+	ErrMissingHeaders = errors.New("missing webhook signature headers")
+	// ErrTimestamp is returned when the timestamp is invalid or outside the tolerated window.
+	ErrTimestamp = errors.New("webhook timestamp is invalid or outside the tolerated window")
+	// ErrInvalidSignature is returned when no signature matches any of the secrets.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrReplayed is returned when the message ID was seen before.
+	ErrReplayed = errors.New("webhook message was already received")
+)
+
+// Verifier verifies the signatures of webhook requests.
+type Verifier struct {
+	// Name of the webhook, so that webhooks sharing a NonceStore do not reject each other's message IDs.
+	name string
+	// Several secrets may be valid at once, so they can be rotated without downtime.
+	secrets   [][]byte
+	tolerance time.Duration
+	nonces    NonceStore
+
+	// Controllable clock for tests.
+	now func() time.Time
+}
+
+// NewVerifier returns a Verifier for the named webhook, that accepts signatures made with any of the given secrets, and
+// timestamps within the given tolerance of the current time. Message IDs are remembered in the given store, prefixed
+// with the name of the webhook, since IDs are only unique per provider.
+//
+// Secrets with the "whsec_" prefix are base64-decoded. Others are used as they are.
+func NewVerifier(name string, secrets []string, tolerance time.Duration, nonces NonceStore) (*Verifier, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("at least one secret is required")
+	}
+
+	verifier := &Verifier{name: name, tolerance: tolerance, nonces: nonces, now: time.Now}
+	for _, secret := range secrets {
+		if encoded, found := strings.CutPrefix(secret, secretPrefix); found {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode webhook secret: %w", err)
+			}
+			verifier.secrets = append(verifier.secrets, decoded)
+			continue
+		}
+		verifier.secrets = append(verifier.secrets, []byte(secret))
+	}
+
+	return verifier, nil
+}
+
+// Verify returns nil if the request with the given headers and body is correctly signed and is not a replay.
+//
+// The message ID is remembered right away, so that concurrent deliveries of the same message are rejected too. If the
+// message cannot be processed, Forget must be called, so that the sender can retry it.
+func (v *Verifier) Verify(ctx context.Context, header http.Header, body []byte) error {
+	id, timestamp, signatures := header.Get(HeaderID), header.Get(HeaderTimestamp), header.Get(HeaderSignature)
+	if id == "" || timestamp == "" || signatures == "" {
+		return ErrMissingHeaders
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrTimestamp
+	}
+	if age := v.now().Sub(time.Unix(unix, 0)); age > v.tolerance || age < -v.tolerance {
+		return ErrTimestamp
+	}
+
+	if !v.matches(id+"."+timestamp+"."+string(body), signatures) {
+		return ErrInvalidSignature
+	}
+
+	// The message ID is checked last, so that unsigned requests cannot use up the IDs of genuine ones.
+	// Timestamps older than the tolerance are rejected anyway, so the IDs need not be remembered for any longer.
+	fresh, err := v.nonces.Add(ctx, v.nonce(id), 2*v.tolerance)
+	if err != nil {
+		return fmt.Errorf("failed to check the webhook message id: %w", err)
+	}
+	if !fresh {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
+// Forget makes the message ID of the request with the given headers available again. It is meant for messages that
+// were verified but failed to be processed, since the sender retries them with the same ID.
+func (v *Verifier) Forget(ctx context.Context, header http.Header) error {
+	id := header.Get(HeaderID)
+	if id == "" {
+		return nil
+	}
+	if err := v.nonces.Remove(ctx, v.nonce(id)); err != nil {
+		return fmt.Errorf("failed to forget the webhook message id: %w", err)
+	}
+	return nil
+}
+
+// nonce returns the key of the given message ID in the NonceStore.
+func (v *Verifier) nonce(id string) string {
+	return v.name + ":" + id
+}
+
+// matches reports whether any of the space-separated signatures is valid for the content under any of the secrets.
+func (v *Verifier) matches(content string, signatures string) bool {
+	for _, secret := range v.secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(content))
+		expected := mac.Sum(nil)
+
+		for _, signature := range strings.Fields(signatures) {
+			version, encoded, _ := strings.Cut(signature, ",")
+			if version != "v1" {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err == nil && hmac.Equal(decoded, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header value of the given message under the given secret. It is meant for tests and for
+// sending webhooks.
+func Sign(secret []byte, id string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "." + strconv.FormatInt(timestamp.Unix(), 10) + "." + string(body)))
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NonceStore remembers the message IDs of received webhooks. Implementations must be safe for concurrent use.
+type NonceStore interface {
+	// Add remembers the nonce for the given duration. It returns false if the nonce is already remembered.
+	Add(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+	// Remove forgets the nonce, so that it can be added again. Removing an absent nonce is not an error.
+	Remove(ctx context.Context, nonce string) error
+}
+
+// MemoryStore is an in-memory NonceStore. Expired nonces are swept periodically.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	expiries  map[string]time.Time
+	nextSweep time.Time
+
+	// Controllable clock for tests.
+	now func() time.Time
+}
+
+// sweepInterval is how often expired nonces are removed from a MemoryStore.
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{expiries: map[string]time.Time{}, now: time.Now}
+}
+
+// Add implements NonceStore.
+func (m *MemoryStore) Add(_ context.Context, nonce string, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	if now.After(m.nextSweep) {
+		for key, expiry := range m.expiries {
+			if now.After(expiry) {
+				delete(m.expiries, key)
+			}
+		}
+		m.nextSweep = now.Add(sweepInterval)
+	}
+
+	if expiry, exists := m.expiries[nonce]; exists && !now.After(expiry) {
+		return false, nil
+	}
+
+	m.expiries[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+// Remove implements NonceStore.
+func (m *MemoryStore) Remove(_ context.Context, nonce string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.expiries, nonce)
+	return nil
+}
@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Now()
+	oldSecret, newSecret := []byte("old-secret"), []byte("new-secret")
+
+	// Both secrets are valid during rotation. The new one is given in the provider's format.
+	verifier, err := NewVerifier("partner",
+		[]string{string(oldSecret), secretPrefix + base64.StdEncoding.EncodeToString(newSecret)},
+		5*time.Minute, NewMemoryStore(),
+	)
+	require.NoError(t, err)
+	verifier.now = func() time.Time { return now }
+
+	body := []byte(`{"event":"invoice.paid"}`)
+
+	// Convenience function to build signed headers.
+	signed := func(id string, timestamp time.Time, signature string) http.Header {
+		header := http.Header{}
+		header.Set(HeaderID, id)
+		header.Set(HeaderTimestamp, strconv.FormatInt(timestamp.Unix(), 10))
+		header.Set(HeaderSignature, signature)
+		return header
+	}
+
+	testCases := []struct {
+		name          string
+		header        http.Header
+		body          []byte
+		expectedError error
+	}{
+		{name: "Old secret", header: signed("msg-1", now, Sign(oldSecret, "msg-1", now, body)), body: body},
+		{name: "New secret", header: signed("msg-2", now, Sign(newSecret, "msg-2", now, body)), body: body},
+		{
+			name:   "Several signatures",
+			header: signed("msg-3", now, "v1,bm9wZQ== "+Sign(newSecret, "msg-3", now, body)),
+			body:   body,
+		},
+		{name: "Missing headers", header: http.Header{}, body: body, expectedError: ErrMissingHeaders},
+		{
+			name:          "Tampered body",
+			header:        signed("msg-4", now, Sign(newSecret, "msg-4", now, body)),
+			body:          []byte(`{"event":"invoice.refunded"}`),
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "Unknown secret",
+			header:        signed("msg-5", now, Sign([]byte("other"), "msg-5", now, body)),
+			body:          body,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "Too old",
+			header:        signed("msg-6", now.Add(-time.Hour), Sign(newSecret, "msg-6", now.Add(-time.Hour), body)),
+			body:          body,
+			expectedError: ErrTimestamp,
+		},
+		{
+			name:          "Replayed",
+			header:        signed("msg-1", now, Sign(oldSecret, "msg-1", now, body)),
+			body:          body,
+			expectedError: ErrReplayed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifier.Verify(context.Background(), tc.header, tc.body)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestVerifier_SharedStore(t *testing.T) {
+	now, body := time.Now(), []byte(`{"event":"invoice.paid"}`)
+	store := NewMemoryStore()
+
+	// Convenience function to verify a message signed for the named webhook.
+	verify := func(name, id string) error {
+		verifier, err := NewVerifier(name, []string{"secret"}, 5*time.Minute, store)
+		require.NoError(t, err)
+		verifier.now = func() time.Time { return now }
+
+		header := http.Header{}
+		header.Set(HeaderID, id)
+		header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+		header.Set(HeaderSignature, Sign([]byte("secret"), id, now, body))
+		return verifier.Verify(context.Background(), header, body)
+	}
+
+	// Message IDs are only unique per provider, so the same ID from two webhooks is not a replay.
+	require.NoError(t, verify("partner", "msg-1"))
+	require.NoError(t, verify("billing", "msg-1"))
+	require.ErrorIs(t, verify("partner", "msg-1"), ErrReplayed)
+
+	// A forgotten message ID can be retried, without affecting the other webhooks.
+	verifier, err := NewVerifier("partner", []string{"secret"}, 5*time.Minute, store)
+	require.NoError(t, err)
+	header := http.Header{}
+	header.Set(HeaderID, "msg-1")
+	require.NoError(t, verifier.Forget(context.Background(), header))
+	require.NoError(t, verify("partner", "msg-1"))
+	require.ErrorIs(t, verify("billing", "msg-1"), ErrReplayed)
+}
+
+func TestMemoryStore_Add(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	fresh, err := store.Add(context.Background(), "nonce", time.Minute)
+	require.NoError(t, err)
+	require.True(t, fresh)
+
+	fresh, err = store.Add(context.Background(), "nonce", time.Minute)
+	require.NoError(t, err)
+	require.False(t, fresh)
+
+	// Expired nonces are forgotten.
+	now = now.Add(2 * time.Minute)
+	fresh, err = store.Add(context.Background(), "nonce", time.Minute)
+	require.NoError(t, err)
+	require.True(t, fresh)
+	require.Len(t, store.expiries, 1)
+}
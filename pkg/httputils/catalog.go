@@ -0,0 +1,188 @@
+package httputils
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// catalogEntry is the public message of a registered error code.
+type catalogEntry struct {
+	// message is used when the client accepts none of the translated locales.
+	message string
+	// translations of the message by lowercase locale, like "fr" or "pt-br".
+	translations map[string]translation
+}
+
+// translation is the message of an error code in a locale, like "pt-BR", as registered.
+type translation struct {
+	locale  string
+	message string
+}
+
+// catalog holds the registered error codes. Codes are registered at startup, but read by every request.
+var catalog = struct {
+	sync.RWMutex
+	entries map[string]catalogEntry
+}{entries: map[string]catalogEntry{}}
+
+// unregisteredCodes are the codes without a catalog entry that WriteErrorFor has already warned about, so that each is
+// logged only once.
+var unregisteredCodes sync.Map // string -> struct{}
+
+// RegisterCode registers the public message of an error code, along with its translations by locale, like "fr" or
+// "pt-BR". It is meant to be called at startup, usually from an init function.
+//
+// WriteErrorFor replaces the reason of the errors with a registered code with the message in the language that the
+// client prefers, as per its Accept-Language header. Use CheckCatalog to make sure that no translation is missing.
+//
+// It panics if the code is empty or already registered.
+func RegisterCode(code, message string, translations map[string]string) {
+	if code == "" {
+		panic("httputils: error code must not be empty")
+	}
+
+	entry := catalogEntry{message: message, translations: make(map[string]translation, len(translations))}
+	for locale, translated := range translations {
+		entry.translations[strings.ToLower(locale)] = translation{locale: locale, message: translated}
+	}
+
+	catalog.Lock()
+	defer catalog.Unlock()
+
+	if _, exists := catalog.entries[code]; exists {
+		panic(fmt.Sprintf("httputils: error code %q is already registered", code))
+	}
+	catalog.entries[code] = entry
+}
+
+// AddTranslations adds translations to the message of an error code that is already registered, like the codes of
+// this package. It is meant to be called at startup, usually from an init function.
+//
+// It panics if the code is not registered, or if a locale is already translated.
+func AddTranslations(code string, translations map[string]string) {
+	catalog.Lock()
+	defer catalog.Unlock()
+
+	entry, exists := catalog.entries[code]
+	if !exists {
+		panic(fmt.Sprintf("httputils: error code %q is not registered", code))
+	}
+	for locale, translated := range translations {
+		if _, exists := entry.translations[strings.ToLower(locale)]; exists {
+			panic(fmt.Sprintf("httputils: error code %q is already translated to %q", code, locale))
+		}
+		entry.translations[strings.ToLower(locale)] = translation{locale: locale, message: translated}
+	}
+}
+
+// CheckCatalog returns an error listing the registered codes that have no message for any of the given locales.
+// It is meant to be called at startup, once all codes are registered.
+func CheckCatalog(locales ...string) error {
+	catalog.RLock()
+	defer catalog.RUnlock()
+
+	var errs []error
+	for _, code := range slices.Sorted(maps.Keys(catalog.entries)) {
+		entry := catalog.entries[code]
+		if entry.message == "" {
+			errs = append(errs, fmt.Errorf("error code %q has no default message", code))
+		}
+		for _, locale := range locales {
+			if entry.translations[strings.ToLower(locale)].message == "" {
+				errs = append(errs, fmt.Errorf("error code %q has no message for locale %q", code, locale))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// localize returns a copy of the error with the reason in the client's preferred language, and the locale of the
+// reason, if the code of the error is registered. Otherwise, it returns the error as is.
+func localize(r *http.Request, errHTTP *Error) (*Error, string) {
+	if errHTTP.Code == "" {
+		return errHTTP, ""
+	}
+
+	catalog.RLock()
+	entry, exists := catalog.entries[errHTTP.Code]
+	catalog.RUnlock()
+	if !exists {
+		// The code may be a typo, or its message was forgotten, so its reason is written as it is.
+		if _, warned := unregisteredCodes.LoadOrStore(errHTTP.Code, struct{}{}); !warned {
+			slog.Warn("error code is not registered in the catalog", "code", errHTTP.Code)
+		}
+		return errHTTP, ""
+	}
+
+	// The error is copied, since it may be shared, like a package-level error value.
+	localized := *errHTTP
+	localized.Reason = entry.message
+
+	if r == nil {
+		return &localized, ""
+	}
+
+	for _, locale := range acceptedLocales(r.Header.Get("Accept-Language")) {
+		if translated, exists := entry.translations[locale]; exists {
+			localized.Reason = translated.message
+			return &localized, translated.locale
+		}
+		// A client that accepts "fr-CH" is better served in "fr" than in the default language.
+		if base, _, found := strings.Cut(locale, "-"); found {
+			if translated, exists := entry.translations[base]; exists {
+				localized.Reason = translated.message
+				return &localized, translated.locale
+			}
+		}
+	}
+	return &localized, ""
+}
+
+// acceptedLocales parses the Accept-Language header into lowercase locales, in the order of preference. The wildcard
+// and the locales with a quality of zero are left out.
+func acceptedLocales(header string) []string {
+	type weighted struct {
+		locale  string
+		quality float64
+	}
+
+	var accepted []weighted
+	for _, entry := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		locale = strings.ToLower(strings.TrimSpace(locale))
+		if locale == "" || locale == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		accepted = append(accepted, weighted{locale: locale, quality: quality})
+	}
+
+	// Stable, so that locales with the same quality keep the client's order.
+	slices.SortStableFunc(accepted, func(a, b weighted) int { return cmp.Compare(b.quality, a.quality) })
+
+	locales := make([]string, len(accepted))
+	for i, a := range accepted {
+		locales[i] = a.locale
+	}
+	return locales
+}
@@ -0,0 +1,198 @@
+package httputils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encoding is a response encoding that Write can negotiate.
+type encoding struct {
+	// mediaType is the content-type of the encoded body.
+	mediaType string
+	// sliceOnly is true if the encoding can only encode slices and arrays, like NDJSON.
+	sliceOnly bool
+	// marshal encodes the body.
+	marshal func(body any) ([]byte, error)
+}
+
+// encodings are the response encodings that Write supports, in the order of the server's preference. It is used to
+// break ties between media types that the client accepts equally.
+var encodings = []encoding{
+	{mediaType: "application/json", marshal: json.Marshal},
+	{mediaType: "application/x-ndjson", sliceOnly: true, marshal: marshalNDJSON},
+	{mediaType: "application/cbor", marshal: cbor.Marshal},
+	{mediaType: "application/msgpack", marshal: marshalMsgpack},
+	// Aliases used by some MessagePack clients.
+	{mediaType: "application/vnd.msgpack", marshal: marshalMsgpack},
+	{mediaType: "application/x-msgpack", marshal: marshalMsgpack},
+}
+
+// Write encodes the given body in the format that the client prefers, as per its Accept header, and writes it as the
+// http response with the given status code. Headers must be set on the writer beforehand.
+//
+// The supported formats are JSON, NDJSON (only if the body is a slice or an array), CBOR and MessagePack. Clients
+// without a preference get JSON. Clients that accept none of the formats get a 406 Not Acceptable error. The request
+// may be nil if it is not available, in which case JSON is written.
+//
+// All formats use the "json" struct tags of the body, so the same types serve every client.
+func Write(writer http.ResponseWriter, r *http.Request, status int, body any) {
+	addVary(writer.Header(), "Accept")
+
+	accept := ""
+	if r != nil {
+		accept = r.Header.Get("Accept")
+	}
+
+	enc, ok := negotiate(accept, isSlice(body))
+	if !ok {
+		WriteErrorFor(writer, r, NotAcceptable().WithReasonStr("supported media types are "+supportedTypes(body)))
+		return
+	}
+
+	responseBytes, err := enc.marshal(body)
+	if err != nil {
+		WriteErrorFor(writer, r, InternalServerError().WithCause(fmt.Errorf("failed to encode body as %s: %w",
+			enc.mediaType, err)))
+		return
+	}
+
+	writer.Header().Set("content-type", enc.mediaType)
+	writer.Header().Set("content-length", strconv.Itoa(len(responseBytes)))
+	writer.WriteHeader(status)
+	_, _ = writer.Write(responseBytes)
+}
+
+// negotiate returns the encoding that the given Accept header prefers. An empty header accepts any encoding.
+// The slice-only encodings are considered only if the body is a slice.
+func negotiate(accept string, slice bool) (encoding, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return encodings[0], true
+	}
+
+	ranges := parseAccept(accept)
+
+	var best encoding
+	bestQuality := 0.0
+	for _, enc := range encodings {
+		if enc.sliceOnly && !slice {
+			continue
+		}
+		// Strictly greater, so that ties go to the encoding that comes first.
+		if quality := acceptQuality(ranges, enc.mediaType); quality > bestQuality {
+			best, bestQuality = enc, quality
+		}
+	}
+	return best, bestQuality > 0
+}
+
+// mediaRange is an entry of the Accept header, like "application/*;q=0.5".
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// parseAccept parses the Accept header into media ranges. Malformed entries are left out.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if value, exists := params["q"]; exists {
+			if quality, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, quality: quality})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the given media type, as per the most specific of the matching ranges.
+// It is zero if no range matches.
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, 0
+	for _, r := range ranges {
+		var matched int
+		switch r.mediaType {
+		case mediaType:
+			matched = 3
+		case mainType + "/*":
+			matched = 2
+		case "*/*":
+			matched = 1
+		default:
+			continue
+		}
+		if matched > specificity {
+			quality, specificity = r.quality, matched
+		}
+	}
+	return quality
+}
+
+// supportedTypes lists the media types that Write can encode the given body in, for error messages.
+func supportedTypes(body any) string {
+	slice := isSlice(body)
+
+	types := make([]string, 0, len(encodings))
+	for _, enc := range encodings {
+		if !enc.sliceOnly || slice {
+			types = append(types, enc.mediaType)
+		}
+	}
+	return strings.Join(types, ", ")
+}
+
+// isSlice reports whether the body is a slice or an array, other than a byte slice, which JSON encodes as a string.
+func isSlice(body any) bool {
+	if body == nil {
+		return false
+	}
+
+	value := reflect.ValueOf(body)
+	kind := value.Kind()
+	return (kind == reflect.Slice || kind == reflect.Array) && value.Type().Elem().Kind() != reflect.Uint8
+}
+
+// marshalNDJSON encodes each element of the given slice or array as JSON, on its own line.
+func marshalNDJSON(body any) ([]byte, error) {
+	value := reflect.ValueOf(body)
+
+	buffer := &bytes.Buffer{}
+	for i := range value.Len() {
+		elementBytes, err := json.Marshal(value.Index(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal element %d: %w", i, err)
+		}
+		buffer.Write(elementBytes)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
+
+// marshalMsgpack encodes the body as MessagePack, using the "json" struct tags like the other encodings.
+func marshalMsgpack(body any) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+
+	encoder := msgpack.NewEncoder(buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(body); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package httputils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// mockReading is the response body used by the tests.
+type mockReading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+}
+
+func TestWrite(t *testing.T) {
+	readings := []mockReading{{Sensor: "t1", Value: 21.5, Unit: "C"}, {Sensor: "h1", Value: 40}}
+
+	testCases := []struct {
+		name         string
+		accept       string
+		body         any
+		expectedCode int
+		expectedType string
+	}{
+		{name: "No preference", body: readings[0], expectedCode: http.StatusOK, expectedType: "application/json"},
+		{
+			name:         "Wildcard prefers JSON",
+			accept:       "*/*",
+			body:         readings,
+			expectedCode: http.StatusOK,
+			expectedType: "application/json",
+		},
+		{
+			name:         "NDJSON for a slice",
+			accept:       "application/x-ndjson",
+			body:         readings,
+			expectedCode: http.StatusOK,
+			expectedType: "application/x-ndjson",
+		},
+		{
+			name:         "NDJSON for an object",
+			accept:       "application/x-ndjson",
+			body:         readings[0],
+			expectedCode: http.StatusNotAcceptable,
+			expectedType: "application/json",
+		},
+		{
+			name:         "CBOR by quality",
+			accept:       "application/json;q=0.5, application/cbor",
+			body:         readings[0],
+			expectedCode: http.StatusOK,
+			expectedType: "application/cbor",
+		},
+		{
+			name:         "MessagePack alias",
+			accept:       "application/vnd.msgpack, application/*;q=0.1",
+			body:         readings[0],
+			expectedCode: http.StatusOK,
+			expectedType: "application/vnd.msgpack",
+		},
+		{
+			name:         "Refused JSON",
+			accept:       "application/json;q=0, */*",
+			body:         readings[0],
+			expectedCode: http.StatusOK,
+			expectedType: "application/cbor",
+		},
+		{
+			name:         "Unsupported",
+			accept:       "text/html, application/xml",
+			body:         readings[0],
+			expectedCode: http.StatusNotAcceptable,
+			expectedType: "application/json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/readings", nil)
+			if tc.accept != "" {
+				request.Header.Set("Accept", tc.accept)
+			}
+
+			recorder := httptest.NewRecorder()
+			Write(recorder, request, http.StatusOK, tc.body)
+
+			require.Equal(t, tc.expectedCode, recorder.Code)
+			require.Equal(t, tc.expectedType, recorder.Header().Get("Content-Type"))
+			require.Contains(t, recorder.Header().Values("Vary"), "Accept")
+		})
+	}
+}
+
+func TestWrite_Encodings(t *testing.T) {
+	reading := mockReading{Sensor: "t1", Value: 21.5}
+
+	write := func(accept string, body any) []byte {
+		request := httptest.NewRequest(http.MethodGet, "/readings", nil)
+		request.Header.Set("Accept", accept)
+
+		recorder := httptest.NewRecorder()
+		Write(recorder, request, http.StatusOK, body)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.Bytes()
+	}
+
+	require.JSONEq(t, `{"sensor":"t1","value":21.5}`, string(write("application/json", reading)))
+	require.Equal(t, "{\"sensor\":\"t1\",\"value\":21.5}\n{\"sensor\":\"h1\",\"value\":40}\n",
+		string(write("application/x-ndjson", []mockReading{reading, {Sensor: "h1", Value: 40}})))
+
+	// The binary encodings use the json tags, so they decode into a generic map with the same keys.
+	var decoded map[string]any
+	require.NoError(t, cbor.Unmarshal(write("application/cbor", reading), &decoded))
+	require.Equal(t, map[string]any{"sensor": "t1", "value": 21.5}, decoded)
+
+	decoded = nil
+	require.NoError(t, msgpack.Unmarshal(write("application/msgpack", reading), &decoded))
+	require.Equal(t, map[string]any{"sensor": "t1", "value": 21.5}, decoded)
+}
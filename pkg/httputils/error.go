@@ -1,15 +1,32 @@
 package httputils
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
+	"strings"
 )
 
+// maxStackDepth is the max number of frames kept in the stack of an Error.
+const maxStackDepth = 32
+
 // Error represents http errors, and implements the error interface.
 type Error struct {
 	StatusCode int    `json:"-"`
 	Status     string `json:"status"`
 	Reason     string `json:"reason"`
+	// Code is a stable, machine-readable identifier of the error, like "USER_EMAIL_TAKEN". Clients can map it to
+	// their own messages, unlike the free-text Reason.
+	Code string `json:"code,omitempty"`
+	// Details lists the invalid fields of the request, if any.
+	Details []FieldError `json:"details,omitempty"`
+
+	// cause is the internal error behind the Error. It is logged by WriteError, but never sent to the client.
+	cause error
+	// stack is where the cause was attached, for the logs. Errors without a cause have no stack.
+	stack []uintptr
 }
 
 // Error provides the reason behind the error, which is usually human-readable.
@@ -30,16 +47,63 @@ func (e *Error) WithReasonStr(reason string) *Error {
 	return e
 }
 
-// WithReasonErr is a chainable method to set the reason of the Error.
+// WithReasonErr is a chainable method to attach an error to the Error.
 //
-// This accepts the reason as an error.
+// The error is kept as the cause, just like with WithCause. Its message is not copied into the reason, since the
+// messages of internal errors, like those of a database, must not reach the client. The reason stays as it was, which
+// is the generic status unless set with WithReasonStr.
+//
+// Deprecated: Use WithCause, along with WithReasonStr for the public message.
 func (e *Error) WithReasonErr(reason error) *Error {
-	e.Reason = reason.Error()
+	return e.withCause(reason, 1)
+}
+
+// WithCause is a chainable method to set the internal error behind the Error. The cause is logged by WriteError along
+// with the stack of the WithCause call, but it is never sent to the client.
+func (e *Error) WithCause(cause error) *Error {
+	return e.withCause(cause, 1)
+}
+
+// withCause sets the cause of the Error and captures the stack of the caller, skipping the given number of frames
+// above it.
+func (e *Error) withCause(cause error, skip int) *Error {
+	e.cause = cause
+	e.stack = make([]uintptr, maxStackDepth)
+	// Skip runtime.Callers and withCause.
+	e.stack = e.stack[:runtime.Callers(2+skip, e.stack)]
+	return e
+}
+
+// Unwrap returns the cause of the Error, so that errors.Is and errors.As can inspect it.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// WithCode is a chainable method to set the machine-readable code of the Error.
+func (e *Error) WithCode(code string) *Error {
+	e.Code = code
+	return e
+}
+
+// WithDetails is a chainable method to add details about the invalid fields of the request to the Error.
+func (e *Error) WithDetails(details ...FieldError) *Error {
+	e.Details = append(e.Details, details...)
 	return e
 }
 
 // ToError converts any value to an appropriate Error.
+//
+// Values that are not an Error become its cause. Since they carry no stack of their own, the stack of the ToError
+// call is logged with them, which is usually the WriteError call of the handler.
 func ToError(err any) *Error {
+	return toError(err, 1)
+}
+
+// toError implements ToError. Its stack starts at the caller, skipping the given number of frames above it.
+func toError(err any, skip int) *Error {
+	// Skip toError as well.
+	skip++
+
 	switch asserted := err.(type) {
 	case *Error:
 		return asserted
@@ -50,27 +114,60 @@ func ToError(err any) *Error {
 		if errors.As(asserted, &errHTTP) {
 			return errHTTP
 		}
-		return InternalServerError().WithReasonErr(asserted)
+		// A deadline exceeded on a downstream call means the request could not be completed in time.
+		if errors.Is(asserted, context.DeadlineExceeded) {
+			return GatewayTimeout().withCause(asserted, skip)
+		}
+		return InternalServerError().withCause(asserted, skip)
 	case string:
-		return InternalServerError().WithReasonStr(asserted)
+		return InternalServerError().withCause(errors.New(asserted), skip)
 	default:
-		return InternalServerError()
+		return InternalServerError().withCause(fmt.Errorf("%v", asserted), skip)
+	}
+}
+
+// stackTrace formats the stack of the Error with one "function file:line" per line.
+func (e *Error) stackTrace() string {
+	if len(e.stack) == 0 {
+		return ""
 	}
+
+	var builder strings.Builder
+	frames := runtime.CallersFrames(e.stack)
+	for {
+		frame, more := frames.Next()
+		_, _ = fmt.Fprintf(&builder, "%s %s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return builder.String()
 }
 
 // NewError returns the Error instance for the code. It derives the Status value from the code too.
 func NewError(code int) *Error {
+	return newError(code)
+}
+
+// newError creates the Error. Most errors are plain client errors that are never logged, so no stack is captured
+// until a cause is attached.
+func newError(code int) *Error {
 	statusText := http.StatusText(code) // Example: 400 -> Bad Request
 	return &Error{StatusCode: code, Status: statusText}
 }
 
-func BadRequest() *Error          { return NewError(http.StatusBadRequest) }
-func Unauthorized() *Error        { return NewError(http.StatusUnauthorized) }
-func PaymentRequired() *Error     { return NewError(http.StatusPaymentRequired) }
-func Forbidden() *Error           { return NewError(http.StatusForbidden) }
-func NotFound() *Error            { return NewError(http.StatusNotFound) }
-func RequestTimeout() *Error      { return NewError(http.StatusRequestTimeout) }
-func Conflict() *Error            { return NewError(http.StatusConflict) }
-func PreconditionFailed() *Error  { return NewError(http.StatusPreconditionFailed) }
-func InternalServerError() *Error { return NewError(http.StatusInternalServerError) }
-func ServiceUnavailable() *Error  { return NewError(http.StatusServiceUnavailable) }
+func BadRequest() *Error            { return newError(http.StatusBadRequest) }
+func Unauthorized() *Error          { return newError(http.StatusUnauthorized) }
+func PaymentRequired() *Error       { return newError(http.StatusPaymentRequired) }
+func Forbidden() *Error             { return newError(http.StatusForbidden) }
+func NotFound() *Error              { return newError(http.StatusNotFound) }
+func NotAcceptable() *Error         { return newError(http.StatusNotAcceptable) }
+func RequestTimeout() *Error        { return newError(http.StatusRequestTimeout) }
+func Conflict() *Error              { return newError(http.StatusConflict) }
+func PreconditionFailed() *Error    { return newError(http.StatusPreconditionFailed) }
+func RequestEntityTooLarge() *Error { return newError(http.StatusRequestEntityTooLarge) }
+func UnsupportedMediaType() *Error  { return newError(http.StatusUnsupportedMediaType) }
+func TooManyRequests() *Error       { return newError(http.StatusTooManyRequests) }
+func InternalServerError() *Error   { return newError(http.StatusInternalServerError) }
+func ServiceUnavailable() *Error    { return newError(http.StatusServiceUnavailable) }
+func GatewayTimeout() *Error        { return newError(http.StatusGatewayTimeout) }
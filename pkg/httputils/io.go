@@ -1,10 +1,16 @@
 package httputils
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"reflect"
+	"strings"
 )
 
 // WriteJson marshals the given body to JSON, and writes it as the http response.
@@ -40,8 +46,188 @@ func WriteJson(writer http.ResponseWriter, status int, headers map[string]string
 	_, _ = writer.Write(responseBytes)
 }
 
-// WriteError attempts to convert the given error to the Error type, and then writes it as JSON.
+// WriteError attempts to convert the given error to the Error type, and then writes it as JSON, along with its code
+// and details if present.
+//
+// It is the same as WriteErrorFor without a request, so the client's preferences are unknown. Handlers should prefer
+// WriteErrorFor.
 func WriteError(writer http.ResponseWriter, err error) {
-	errHTTP := ToError(err)
+	writeError(writer, nil, err, 1)
+}
+
+// WriteErrorFor attempts to convert the given error to the Error type, and then writes it as JSON, along with its code
+// and details if present.
+//
+// The error is written as RFC 9457 problem details instead, if configured so with SetProblemOptions, or if the client
+// asks for them. The request may be nil if it is not available, in which case the client's preference is unknown.
+//
+// If the code of the error is registered with RegisterCode, its reason is replaced with the message of the code, in the
+// language that the client prefers. Unregistered codes are logged once each, since they are usually mistakes.
+//
+// The cause of the error, if any, is logged along with the stack where it was attached, using the log context of the
+// request. For plain errors, that is where WriteErrorFor was called. Only the public parts of the error are written to
+// the client.
+func WriteErrorFor(writer http.ResponseWriter, r *http.Request, err error) {
+	writeError(writer, r, err, 1)
+}
+
+// writeError implements WriteError and WriteErrorFor. The stack of plain errors starts at the caller, skipping the
+// given number of frames above it.
+func writeError(writer http.ResponseWriter, r *http.Request, err error, skip int) {
+	// Skip writeError as well.
+	errHTTP := toError(err, skip+1)
+	logError(r, errHTTP)
+
+	// The errors with a registered code get their reason from the catalog, in the client's language.
+	if localized, locale := localize(r, errHTTP); localized != errHTTP {
+		errHTTP = localized
+		addVary(writer.Header(), "Accept-Language")
+		if locale != "" {
+			writer.Header().Set("Content-Language", locale)
+		}
+	}
+
+	options := problemOptions.Load()
+	// Unless problem details are always written, the shape of the error depends on the Accept header.
+	if options == nil || !options.Always {
+		addVary(writer.Header(), "Accept")
+	}
+	if wantsProblem(r, options) {
+		headers := map[string]string{"content-type": ProblemContentType}
+		WriteJson(writer, errHTTP.StatusCode, headers, problem(r, errHTTP, options))
+		return
+	}
+
 	WriteJson(writer, errHTTP.StatusCode, nil, errHTTP)
 }
+
+// addVary adds the given header name to the Vary header, unless it is already listed. Vary is additive, since the
+// middleware add their own names too.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// logError logs the cause of the given error. Server errors are logged at the error level, and client errors at the
+// info level, since they are usually the client's fault.
+func logError(r *http.Request, errHTTP *Error) {
+	if errHTTP.cause == nil {
+		return
+	}
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+
+	level := slog.LevelInfo
+	if errHTTP.StatusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	slog.Log(ctx, level, "request failed", "status", errHTTP.StatusCode, "error", errHTTP.cause,
+		"stack", errHTTP.stackTrace())
+}
+
+// CodeValidationFailed is the code of the errors returned by ReadJson when the body fails validation.
+const CodeValidationFailed = "VALIDATION_FAILED"
+
+func init() {
+	// The invalid fields are listed in the details, so the message need not repeat them.
+	RegisterCode(CodeValidationFailed, "The request has invalid fields", nil)
+}
+
+// ReadJson decodes the JSON body of the request into a T, and validates it as per the "validate" struct tags of T.
+// See Validate for the supported rules.
+//
+// The body must have a JSON content-type, must not have fields that are absent from T, and must not have any data
+// after the JSON value. If any of these checks fails, the returned error is an *Error ready to be written with
+// WriteErrorFor, such as a 413 if the body is too large, or a 400 that lists the invalid fields.
+func ReadJson[T any](r *http.Request) (T, error) {
+	var body T
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return body, UnsupportedMediaType().WithReasonStr("content-type must be application/json")
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&body); err != nil {
+		return body, decodeError(err)
+	}
+	// A second value, or any garbage, after the body is an error too.
+	if err := decoder.Decode(&json.RawMessage{}); !errors.Is(err, io.EOF) {
+		var errMaxBytes *http.MaxBytesError
+		if errors.As(err, &errMaxBytes) {
+			return body, decodeError(err)
+		}
+		return body, BadRequest().WithReasonStr("request body must contain a single JSON value")
+	}
+
+	if fieldErrs := Validate(body); len(fieldErrs) > 0 {
+		reasons := make([]string, 0, len(fieldErrs))
+		for _, fieldErr := range fieldErrs {
+			reasons = append(reasons, fieldErr.Field+" "+fieldErr.Message)
+		}
+		return body, BadRequest().
+			WithCode(CodeValidationFailed).
+			WithReasonStr("invalid fields: " + strings.Join(reasons, "; ")).
+			WithDetails(fieldErrs...)
+	}
+
+	return body, nil
+}
+
+// decodeError converts the given JSON decoding error to an Error with a reason that is safe to show to the client.
+func decodeError(err error) *Error {
+	var errMaxBytes *http.MaxBytesError
+	var errSyntax *json.SyntaxError
+	var errType *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &errMaxBytes):
+		return RequestEntityTooLarge().WithReasonStr(fmt.Sprintf("request body must not exceed %d bytes",
+			errMaxBytes.Limit))
+	case errors.Is(err, io.EOF):
+		return BadRequest().WithReasonStr("request body is empty")
+	case errors.As(err, &errSyntax), errors.Is(err, io.ErrUnexpectedEOF):
+		return BadRequest().WithReasonStr("request body is malformed JSON")
+	case errors.As(err, &errType):
+		if errType.Field == "" {
+			return BadRequest().WithReasonStr("request body must be a JSON " + jsonKind(errType.Type.Kind()))
+		}
+		return BadRequest().WithReasonStr(fmt.Sprintf("%s must be a %s", errType.Field,
+			jsonKind(errType.Type.Kind())))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The json package has no error type for this case.
+		return BadRequest().WithReasonStr("unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		return BadRequest().WithReasonStr("failed to decode request body")
+	}
+}
+
+// jsonKind returns the name of the JSON type for the given Go kind, for error messages.
+func jsonKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return kind.String()
+	}
+}
@@ -0,0 +1,507 @@
+package httputils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockUser is the request body used by the tests.
+type mockUser struct {
+	Name    string       `json:"name" validate:"required,min=2,max=10"`
+	Email   string       `json:"email" validate:"required,email"`
+	Role    *string      `json:"role" validate:"oneof=admin member"`
+	Age     *int         `json:"age" validate:"min=18"`
+	Tags    []string     `json:"tags" validate:"max=2"`
+	Address *mockAddress `json:"address"`
+}
+
+type mockAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+func TestReadJson(t *testing.T) {
+	testCases := []struct {
+		name           string
+		contentType    string
+		body           string
+		maxBytes       int64
+		expectedCode   int
+		expectedReason string
+	}{
+		{name: "Valid", body: `{"name":"Shivansh","email":"s@example.com","role":"admin","age":30}`},
+		{name: "Only required", body: `{"name":"Sh","email":"s@example.com"}`},
+		{
+			name:           "Wrong content type",
+			contentType:    "text/plain",
+			body:           `{"name":"Shivansh","email":"s@example.com"}`,
+			expectedCode:   http.StatusUnsupportedMediaType,
+			expectedReason: "content-type must be application/json",
+		},
+		{
+			name:           "Unknown field",
+			body:           `{"name":"Shivansh","email":"s@example.com","admin":true}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: `unknown field "admin"`,
+		},
+		{
+			name:           "Trailing data",
+			body:           `{"name":"Shivansh","email":"s@example.com"} {}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "request body must contain a single JSON value",
+		},
+		{
+			name:           "Malformed",
+			body:           `{"name":`,
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "request body is malformed JSON",
+		},
+		{
+			name:           "Wrong type",
+			body:           `{"name":"Shivansh","email":"s@example.com","age":"thirty"}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "age must be a number",
+		},
+		{name: "Empty", body: ``, expectedCode: http.StatusBadRequest, expectedReason: "request body is empty"},
+		{
+			name:           "Too large",
+			body:           `{"name":"Shivansh","email":"s@example.com"}`,
+			maxBytes:       10,
+			expectedCode:   http.StatusRequestEntityTooLarge,
+			expectedReason: "request body must not exceed 10 bytes",
+		},
+		{
+			name:         "Invalid fields",
+			body:         `{"name":"S","email":"not-an-email","role":"owner","age":12,"tags":["a","b","c"],"address":{}}`,
+			expectedCode: http.StatusBadRequest,
+			expectedReason: "invalid fields: name must be at least 2 characters long; " +
+				"email must be a valid email address; role must be one of: admin, member; age must be at least 18; " +
+				"tags must be at most 2 items long; address.city is required",
+		},
+		{
+			name:           "Missing required",
+			body:           `{}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "invalid fields: name is required; email is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io", strings.NewReader(tc.body))
+			request.Header.Set("Content-Type", "application/json; charset=utf-8")
+			if tc.contentType != "" {
+				request.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.maxBytes > 0 {
+				request.Body = http.MaxBytesReader(httptest.NewRecorder(), request.Body, tc.maxBytes)
+			}
+
+			user, err := ReadJson[mockUser](request)
+			if tc.expectedCode == 0 {
+				require.NoError(t, err)
+				require.NotEmpty(t, user.Name)
+				return
+			}
+
+			errHTTP := ToError(err)
+			require.Equal(t, tc.expectedCode, errHTTP.StatusCode)
+			require.Equal(t, tc.expectedReason, errHTTP.Reason)
+
+			// Validation failures list each field in the details.
+			if strings.HasPrefix(tc.expectedReason, "invalid fields") {
+				require.Equal(t, CodeValidationFailed, errHTTP.Code)
+				require.Len(t, errHTTP.Details, strings.Count(tc.expectedReason, ";")+1)
+			}
+		})
+	}
+}
+
+func TestValidate_Nested(t *testing.T) {
+	type item struct {
+		Quantity int `json:"quantity" validate:"required,max=10"`
+	}
+	type order struct {
+		Items []item `json:"items" validate:"required"`
+	}
+
+	require.Empty(t, Validate(order{Items: []item{{Quantity: 1}}}))
+	require.Equal(t, []FieldError{{Field: "items", Rule: "required", Message: "is required"}}, Validate(order{}))
+	require.Equal(t,
+		[]FieldError{{Field: "items[1].quantity", Rule: "max", Message: "must be at most 10"}},
+		Validate(&order{Items: []item{{Quantity: 1}, {Quantity: 11}}}),
+	)
+
+	// Unknown rules are programming errors.
+	require.Panics(t, func() {
+		Validate(struct {
+			Name string `validate:"uppercase"`
+		}{Name: "x"})
+	})
+}
+
+func TestValidate_Presence(t *testing.T) {
+	type filter struct {
+		// Only pointers, slices and maps can be missing. Other fields are validated even with their zero value.
+		Limit  int      `json:"limit" validate:"min=1"`
+		Order  string   `json:"order" validate:"oneof=asc desc"`
+		Offset *int     `json:"offset" validate:"min=0"`
+		Fields []string `json:"fields" validate:"min=1"`
+		// Fields ignored by JSON are never decoded, so they are not validated.
+		Cursor string `json:"-" validate:"required"`
+	}
+
+	zero := 0
+	require.Equal(t, []FieldError{
+		{Field: "limit", Rule: "min", Message: "must be at least 1"},
+		{Field: "order", Rule: "oneof", Message: "must be one of: asc, desc"},
+	}, Validate(filter{}))
+	require.Empty(t, Validate(filter{Limit: 1, Order: "asc", Offset: &zero}))
+	require.Equal(t, []FieldError{
+		{Field: "fields", Rule: "min", Message: "must be at least 1 items long"},
+	}, Validate(filter{Limit: 1, Order: "desc", Fields: []string{}}))
+}
+
+func TestRegisterRules(t *testing.T) {
+	type address struct {
+		City string `json:"city" validate:"required,max=twenty"`
+	}
+	type user struct {
+		Name    string    `json:"name" validate:"required"`
+		Address []address `json:"address"`
+	}
+	type account struct {
+		Balance float64 `json:"balance" validate:"email"`
+	}
+
+	require.NotPanics(t, RegisterRules[mockUser])
+
+	// The nested types are checked too, even if no value of them would be validated.
+	require.PanicsWithValue(t,
+		`invalid validation rule "max=twenty" of field address.City: bound must be a number`,
+		RegisterRules[user])
+	require.PanicsWithValue(t,
+		`invalid validation rule "email" of field account.Balance: rule does not apply to float64`,
+		func() { Validate(account{}) })
+}
+
+func TestWriteError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		expectedBody string
+	}{
+		{
+			name:         "Reason only",
+			err:          NotFound().WithReasonStr("user not found"),
+			expectedBody: `{"status":"Not Found","reason":"user not found"}`,
+		},
+		{
+			name:         "With code",
+			err:          Conflict().WithReasonStr("email is taken").WithCode("USER_EMAIL_TAKEN"),
+			expectedBody: `{"status":"Conflict","reason":"email is taken","code":"USER_EMAIL_TAKEN"}`,
+		},
+		{
+			name: "With details, wrapped",
+			err: fmt.Errorf("failed to create user: %w", BadRequest().WithCode(CodeValidationFailed).
+				WithDetails(FieldError{Field: "email", Rule: "email", Message: "must be a valid email address"})),
+			expectedBody: `{"status":"Bad Request","reason":"The request has invalid fields","code":"VALIDATION_FAILED",` +
+				`"details":[{"field":"email","rule":"email","message":"must be a valid email address"}]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			WriteError(recorder, tc.err)
+			require.JSONEq(t, tc.expectedBody, recorder.Body.String())
+		})
+	}
+}
+
+func TestWriteError_Problem(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global problem options.
+	t.Cleanup(func() { SetProblemOptions(ProblemOptions{}) })
+
+	err := Conflict().WithReasonStr("email is taken").WithCode("USER_EMAIL_TAKEN")
+
+	testCases := []struct {
+		name            string
+		options         ProblemOptions
+		accept          string
+		expectedType    string
+		expectedBody    string
+		expectedProblem bool
+	}{
+		{
+			name:         "Default",
+			accept:       "application/json, */*",
+			expectedType: "application/json",
+			expectedBody: `{"status":"Conflict","reason":"email is taken","code":"USER_EMAIL_TAKEN"}`,
+		},
+		{
+			name:         "Refused by the client",
+			accept:       "application/problem+json;q=0, application/json",
+			expectedType: "application/json",
+			expectedBody: `{"status":"Conflict","reason":"email is taken","code":"USER_EMAIL_TAKEN"}`,
+		},
+		{
+			name:         "Asked by the client",
+			accept:       "application/problem+json",
+			expectedType: ProblemContentType,
+			expectedBody: `{"type":"about:blank","title":"Conflict","status":409,"detail":"email is taken",` +
+				`"instance":"/users","code":"USER_EMAIL_TAKEN"}`,
+		},
+		{
+			name: "Always, with type URI and extensions",
+			options: ProblemOptions{
+				Always:      true,
+				TypeBaseURI: "https://squelette.shivansh.io/problems/",
+				Extensions: func(r *http.Request) map[string]any {
+					return map[string]any{"correlationID": "abc", "status": "ignored"}
+				},
+			},
+			expectedType: ProblemContentType,
+			expectedBody: `{"type":"https://squelette.shivansh.io/problems/USER_EMAIL_TAKEN","title":"Conflict",` +
+				`"status":409,"detail":"email is taken","instance":"/users","code":"USER_EMAIL_TAKEN",` +
+				`"correlationID":"abc"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetProblemOptions(tc.options)
+
+			request := httptest.NewRequest(http.MethodPost, "https://squelette.shivansh.io/users", nil)
+			if tc.accept != "" {
+				request.Header.Set("Accept", tc.accept)
+			}
+
+			recorder := httptest.NewRecorder()
+			WriteErrorFor(recorder, request, err)
+
+			require.Equal(t, http.StatusConflict, recorder.Code)
+			require.Equal(t, tc.expectedType, recorder.Header().Get("Content-Type"))
+			require.JSONEq(t, tc.expectedBody, recorder.Body.String())
+			// The response depends on the Accept header, unless problem details are always written.
+			if tc.options.Always {
+				require.Empty(t, recorder.Header().Values("Vary"))
+			} else {
+				require.Equal(t, []string{"Accept"}, recorder.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestWriteError_Cause(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global logger object.
+	logs := &bytes.Buffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	errDatabase := errors.New("pq: relation \"users\" does not exist")
+
+	testCases := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Plain error",
+			err:          fmt.Errorf("failed to get user: %w", errDatabase),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: `{"status":"Internal Server Error","reason":""}`,
+		},
+		{
+			name:         "Error with cause",
+			err:          ServiceUnavailable().WithReasonStr("try again later").WithCause(errDatabase),
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: `{"status":"Service Unavailable","reason":"try again later"}`,
+		},
+		{
+			name:         "Error with reason error",
+			err:          InternalServerError().WithReasonErr(errDatabase),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: `{"status":"Internal Server Error","reason":""}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+			require.ErrorIs(t, ToError(tc.err), errDatabase)
+
+			recorder := httptest.NewRecorder()
+			WriteErrorFor(recorder, httptest.NewRequest(http.MethodGet, "/users/1", nil), tc.err)
+			require.Equal(t, tc.expectedCode, recorder.Code)
+			require.JSONEq(t, tc.expectedBody, recorder.Body.String())
+
+			// The cause is logged along with the stack, but never sent to the client.
+			require.NotContains(t, recorder.Body.String(), "pq:")
+			require.Contains(t, logs.String(), "level=ERROR")
+			require.Contains(t, logs.String(), "pq: relation")
+			require.Contains(t, logs.String(), "TestWriteError_Cause")
+			// The stack starts where the cause was attached, or where WriteErrorFor was called for plain errors.
+			require.NotContains(t, logs.String(), "httputils.WriteError")
+			require.NotContains(t, logs.String(), "httputils.writeError")
+			require.NotContains(t, logs.String(), "httputils.toError")
+		})
+	}
+
+	// Client errors without a cause are not logged.
+	logs.Reset()
+	WriteError(httptest.NewRecorder(), NotFound())
+	require.Empty(t, logs.String())
+}
+
+func TestError_Stack(t *testing.T) {
+	errDatabase := errors.New("pq: connection refused")
+
+	testCases := []struct {
+		name string
+		// Creates the error in this test, which must be at the top of the stack.
+		create      func() *Error
+		expectStack bool
+	}{
+		{name: "No cause", create: func() *Error { return NotFound() }},
+		{name: "With cause", create: func() *Error { return BadRequest().WithCause(errDatabase) }, expectStack: true},
+		{
+			name:        "With reason error",
+			create:      func() *Error { return BadRequest().WithReasonErr(errDatabase) },
+			expectStack: true,
+		},
+		{name: "Plain error", create: func() *Error { return ToError(errDatabase) }, expectStack: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trace := tc.create().stackTrace()
+			if !tc.expectStack {
+				require.Empty(t, trace)
+				return
+			}
+
+			top, _, _ := strings.Cut(trace, " ")
+			require.Contains(t, top, "httputils.TestError_Stack")
+		})
+	}
+}
+
+// isolateCatalog gives the test an empty error catalog, and restores the global one once the test is done. The
+// warnings about unregistered codes are forgotten, so that the test sees them.
+func isolateCatalog(t *testing.T) {
+	t.Helper()
+
+	catalog.Lock()
+	saved := catalog.entries
+	catalog.entries = map[string]catalogEntry{}
+	catalog.Unlock()
+	unregisteredCodes.Clear()
+
+	t.Cleanup(func() {
+		catalog.Lock()
+		catalog.entries = saved
+		catalog.Unlock()
+		unregisteredCodes.Clear()
+	})
+}
+
+func TestWriteError_Localized(t *testing.T) {
+	// This test cannot run in parallel because it relies on the global catalog and logger objects.
+	isolateCatalog(t)
+	logs := &bytes.Buffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	RegisterCode("USER_EMAIL_TAKEN", "Email is taken", map[string]string{
+		"fr":    "L'adresse e-mail est déjà utilisée",
+		"pt-BR": "O e-mail já está em uso",
+	})
+
+	err := Conflict().WithReasonStr("email is taken").WithCode("USER_EMAIL_TAKEN")
+
+	testCases := []struct {
+		name             string
+		err              error
+		acceptLanguage   string
+		expectedReason   string
+		expectedLanguage string
+	}{
+		{
+			name:           "No preference",
+			err:            err,
+			expectedReason: "Email is taken",
+		},
+		{
+			name:             "Exact locale",
+			err:              err,
+			acceptLanguage:   "pt-BR",
+			expectedReason:   "O e-mail já está em uso",
+			expectedLanguage: "pt-BR",
+		},
+		{
+			name:             "Base language, by quality",
+			err:              err,
+			acceptLanguage:   "de;q=0.9, fr-CH, en;q=0.5",
+			expectedReason:   "L'adresse e-mail est déjà utilisée",
+			expectedLanguage: "fr",
+		},
+		{
+			name:           "Refused locale",
+			err:            err,
+			acceptLanguage: "fr;q=0, de",
+			expectedReason: "Email is taken",
+		},
+		{
+			name:           "Unregistered code",
+			err:            NotFound().WithReasonStr("user not found").WithCode("TEST_USER_NOT_FOUND"),
+			acceptLanguage: "fr",
+			expectedReason: "user not found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/users", nil)
+			if tc.acceptLanguage != "" {
+				request.Header.Set("Accept-Language", tc.acceptLanguage)
+			}
+
+			recorder := httptest.NewRecorder()
+			WriteErrorFor(recorder, request, tc.err)
+
+			var body Error
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+			require.Equal(t, tc.expectedReason, body.Reason)
+			require.Equal(t, tc.expectedLanguage, recorder.Header().Get("Content-Language"))
+		})
+	}
+
+	// The shared error value is left untouched.
+	require.Equal(t, "email is taken", err.Reason)
+
+	// Unregistered codes are logged once, since they are usually mistakes.
+	require.Equal(t, 1, strings.Count(logs.String(), "error code is not registered"))
+	require.Contains(t, logs.String(), "code=TEST_USER_NOT_FOUND")
+
+	require.NoError(t, CheckCatalog("fr", "PT-br"))
+	require.ErrorContains(t, CheckCatalog("fr", "de"), `error code "USER_EMAIL_TAKEN" has no message for locale "de"`)
+	require.Panics(t, func() { RegisterCode("USER_EMAIL_TAKEN", "Email is taken", nil) })
+
+	// Translations can be added to registered codes, like those of this package.
+	AddTranslations("USER_EMAIL_TAKEN", map[string]string{"de": "Die E-Mail-Adresse wird bereits verwendet"})
+	require.NoError(t, CheckCatalog("fr", "de"))
+	require.Panics(t, func() { AddTranslations("USER_EMAIL_TAKEN", map[string]string{"fr": "Déjà utilisée"}) })
+	require.Panics(t, func() { AddTranslations("USER_NOT_FOUND", map[string]string{"fr": "Introuvable"}) })
+}
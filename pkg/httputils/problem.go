@@ -0,0 +1,89 @@
+package httputils
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ProblemContentType is the content-type of RFC 9457 problem details.
+const ProblemContentType = "application/problem+json"
+
+// ProblemOptions configures how WriteErrorFor writes RFC 9457 problem details.
+//
+// https://www.rfc-editor.org/rfc/rfc9457
+type ProblemOptions struct {
+	// Always write problem details. Otherwise, they are written only to the clients that list
+	// application/problem+json in their Accept header, and others get the {status, reason} shape.
+	Always bool
+	// TypeBaseURI is prefixed to the error code to make the "type" member, like "https://example.com/problems/".
+	// Errors without a code, or all errors if this is empty, get "about:blank".
+	TypeBaseURI string
+	// Extensions returns additional members for the problem details of the request, like its correlation ID.
+	Extensions func(r *http.Request) map[string]any
+}
+
+// problemOptions are the options in effect. They are set once at startup, but read by every request.
+var problemOptions atomic.Pointer[ProblemOptions]
+
+// SetProblemOptions sets how WriteErrorFor writes problem details. It is meant to be called once at startup.
+func SetProblemOptions(options ProblemOptions) {
+	problemOptions.Store(&options)
+}
+
+// wantsProblem reports whether the error response to the request must be problem details.
+func wantsProblem(r *http.Request, options *ProblemOptions) bool {
+	if options != nil && options.Always {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+
+	for _, entry := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil || mediaType != ProblemContentType {
+			continue
+		}
+		// A quality of zero means the type is not acceptable.
+		quality, err := strconv.ParseFloat(params["q"], 64)
+		return err != nil || quality > 0
+	}
+	return false
+}
+
+// problem returns the problem details of the error, as a map so that extension members can be added.
+func problem(r *http.Request, errHTTP *Error, options *ProblemOptions) map[string]any {
+	problemType := "about:blank"
+	if options != nil && options.TypeBaseURI != "" && errHTTP.Code != "" {
+		problemType = options.TypeBaseURI + errHTTP.Code
+	}
+
+	members := map[string]any{}
+	if options != nil && options.Extensions != nil && r != nil {
+		for name, value := range options.Extensions(r) {
+			members[name] = value
+		}
+	}
+
+	// The standard members always win over extensions with the same name.
+	members["type"] = problemType
+	members["title"] = errHTTP.Status
+	members["status"] = errHTTP.StatusCode
+	if errHTTP.Reason != "" {
+		members["detail"] = errHTTP.Reason
+	}
+	if r != nil {
+		members["instance"] = r.URL.Path
+	}
+	if errHTTP.Code != "" {
+		members["code"] = errHTTP.Code
+	}
+	if len(errHTTP.Details) > 0 {
+		members["details"] = errHTTP.Details
+	}
+
+	return members
+}
@@ -0,0 +1,128 @@
+package httputils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// streamFlushInterval is how often the streamed items are flushed to the client, so that it receives them steadily
+// instead of in bursts of the buffer size.
+const streamFlushInterval = 100 * time.Millisecond
+
+// streamBufferSize is the size of the buffer that the streamed items are encoded into before they are written.
+const streamBufferSize = 32 << 10
+
+// streamFormat is how a stream of items is framed.
+type streamFormat struct {
+	contentType string
+	// open and close enclose the items, and separator goes between them.
+	open, separator, close string
+	// terminator goes after every item.
+	terminator string
+}
+
+var (
+	formatJSONArray = streamFormat{contentType: "application/json", open: "[", separator: ",", close: "]"}
+	formatNDJSON    = streamFormat{contentType: "application/x-ndjson", terminator: "\n"}
+)
+
+// StreamJson writes the items of the given sequence as a JSON array, as they are produced, along with the given status
+// code. It is meant for result sets too large to hold in memory, like exports. The route should be exempt from the
+// request timeout, so that the stream is not cut short.
+//
+// Unlike WriteJson, nothing is buffered beyond a few kilobytes, so the content-length header is not set. The items are
+// flushed to the client periodically, and the stream stops with the context error if the client disconnects.
+//
+// The status code is sent along with the first item. If the first item fails to encode, a 500 error is written instead,
+// and the error is returned. If a later item fails, the status is already sent, so the response is aborted with
+// http.ErrAbortHandler instead: the client sees a broken connection rather than a truncated but valid result. For the
+// same reason, an iterator whose source fails halfway should panic with http.ErrAbortHandler too.
+func StreamJson[T any](writer http.ResponseWriter, r *http.Request, status int, seq iter.Seq[T]) error {
+	return stream(writer, r, status, seq, formatJSONArray)
+}
+
+// StreamNDJSON is like StreamJson, but writes each item as JSON on its own line, as per the NDJSON format, which lets
+// clients process the items as they arrive.
+func StreamNDJSON[T any](writer http.ResponseWriter, r *http.Request, status int, seq iter.Seq[T]) error {
+	return stream(writer, r, status, seq, formatNDJSON)
+}
+
+// stream writes the items of the sequence framed as per the given format. See StreamJson.
+func stream[T any](writer http.ResponseWriter, r *http.Request, status int, seq iter.Seq[T],
+	format streamFormat,
+) error {
+	ctx := r.Context()
+	buffer := bufio.NewWriterSize(writer, streamBufferSize)
+	controller := http.NewResponseController(writer)
+
+	started, lastFlush := false, time.Now()
+	// start sends the status code, so that the items can follow it.
+	start := func() {
+		writer.Header().Set("content-type", format.contentType)
+		writer.WriteHeader(status)
+		_, _ = buffer.WriteString(format.open)
+		started = true
+	}
+
+	count := 0
+	for item := range seq {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("client is gone after %d items: %w", count, err)
+		}
+
+		itemBytes, err := json.Marshal(item)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal item %d: %w", count, err)
+			if !started {
+				WriteErrorFor(writer, r, InternalServerError().WithCause(err))
+				return err
+			}
+			// The status is already sent, so the only way to tell the client is to break the response.
+			slog.ErrorContext(ctx, "aborting the stream", "error", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		if !started {
+			start()
+		} else {
+			_, _ = buffer.WriteString(format.separator)
+		}
+		_, _ = buffer.Write(itemBytes)
+		_, _ = buffer.WriteString(format.terminator)
+		count++
+
+		if time.Since(lastFlush) >= streamFlushInterval {
+			if err := flush(buffer, controller); err != nil {
+				return fmt.Errorf("failed to write after %d items: %w", count, err)
+			}
+			lastFlush = time.Now()
+		}
+	}
+
+	if !started {
+		start()
+	}
+	_, _ = buffer.WriteString(format.close)
+	if err := flush(buffer, controller); err != nil {
+		return fmt.Errorf("failed to write after %d items: %w", count, err)
+	}
+	return nil
+}
+
+// flush writes the buffered items to the client, and flushes the underlying writer if it supports it, directly or
+// through Unwrap.
+func flush(buffer *bufio.Writer, controller *http.ResponseController) error {
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+	if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
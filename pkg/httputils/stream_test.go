@@ -0,0 +1,123 @@
+package httputils
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamJson(t *testing.T) {
+	readings := []mockReading{{Sensor: "t1", Value: 21.5, Unit: "C"}, {Sensor: "h1", Value: 40}}
+
+	testCases := []struct {
+		name         string
+		stream       func(http.ResponseWriter, *http.Request, int, iter.Seq[mockReading]) error
+		items        []mockReading
+		expectedType string
+		expectedBody string
+	}{
+		{
+			name:         "JSON array",
+			stream:       StreamJson[mockReading],
+			items:        readings,
+			expectedType: "application/json",
+			expectedBody: `[{"sensor":"t1","value":21.5,"unit":"C"},{"sensor":"h1","value":40}]`,
+		},
+		{
+			name:         "Empty JSON array",
+			stream:       StreamJson[mockReading],
+			expectedType: "application/json",
+			expectedBody: `[]`,
+		},
+		{
+			name:         "NDJSON",
+			stream:       StreamNDJSON[mockReading],
+			items:        readings,
+			expectedType: "application/x-ndjson",
+			expectedBody: "{\"sensor\":\"t1\",\"value\":21.5,\"unit\":\"C\"}\n{\"sensor\":\"h1\",\"value\":40}\n",
+		},
+		{
+			name:         "Empty NDJSON",
+			stream:       StreamNDJSON[mockReading],
+			expectedType: "application/x-ndjson",
+			expectedBody: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			err := tc.stream(recorder, httptest.NewRequest(http.MethodGet, "/exports", nil), http.StatusOK,
+				slices.Values(tc.items))
+
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.Equal(t, tc.expectedType, recorder.Header().Get("Content-Type"))
+			require.Empty(t, recorder.Header().Get("Content-Length"))
+			require.Equal(t, tc.expectedBody, recorder.Body.String())
+			require.True(t, recorder.Flushed)
+		})
+	}
+}
+
+// unwrappingWriter hides the http.Flusher of the writer it wraps, like middleware writers that only implement Unwrap.
+type unwrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (u *unwrappingWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+func TestStreamJson_FlushThroughUnwrap(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	err := StreamNDJSON(&unwrappingWriter{recorder}, httptest.NewRequest(http.MethodGet, "/exports", nil),
+		http.StatusOK, slices.Values([]int{1, 2}))
+
+	require.NoError(t, err)
+	require.Equal(t, "1\n2\n", recorder.Body.String())
+	require.True(t, recorder.Flushed)
+}
+
+func TestStreamJson_Failure(t *testing.T) {
+	// Functions cannot be marshalled to JSON.
+	items := []any{map[string]any{"id": 1}, func() {}}
+
+	// Before the status is sent, the client gets an error response.
+	recorder := httptest.NewRecorder()
+	err := StreamJson(recorder, httptest.NewRequest(http.MethodGet, "/exports", nil), http.StatusOK,
+		slices.Values(items[1:]))
+	require.ErrorContains(t, err, "failed to marshal item 0")
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+	// After the status is sent, the response is aborted.
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		_ = StreamNDJSON(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/exports", nil),
+			http.StatusOK, slices.Values(items))
+	})
+
+	// A client that disconnects stops the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	produced := 0
+	seq := func(yield func(int) bool) {
+		for i := 0; ; i++ {
+			if i == 3 {
+				cancel()
+			}
+			produced++
+			if !yield(i) {
+				return
+			}
+		}
+	}
+
+	request := httptest.NewRequestWithContext(ctx, http.MethodGet, "/exports", nil)
+	err = StreamJson(httptest.NewRecorder(), request, http.StatusOK, seq)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 4, produced)
+}
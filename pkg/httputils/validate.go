@@ -0,0 +1,316 @@
+package httputils
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError describes a field that failed validation.
+type FieldError struct {
+	// Path of the field in the JSON body, like "address.city" or "items[2].quantity".
+	Field string `json:"field"`
+	// The rule that failed, like "required" or "max".
+	Rule string `json:"rule"`
+	// Human-readable description of the failure.
+	Message string `json:"message"`
+}
+
+// Validate checks the given struct against the rules in the "validate" tags of its fields, and returns the fields
+// that failed. Nested structs, pointers and slices of structs are validated too.
+//
+// The supported rules are:
+//   - required: the field must be present, and not the zero value or empty.
+//   - min=N and max=N: bounds on the value of numbers, and on the length of strings, slices and maps.
+//   - email: the field must be an email address.
+//   - oneof=a b c: the field must be one of the space-separated values.
+//
+// A field is missing if it is a nil pointer, slice or map. Fields without the required rule are optional, and the
+// other rules apply to them only when they are present, so optional fields must be pointers, slices or maps. The rules
+// of other fields apply to their zero value too, since it cannot be told apart from an absent field.
+//
+// Invalid tags are programming errors, so they cause a panic when a type is first validated. See RegisterRules to catch
+// them at startup instead.
+func Validate(v any) []FieldError {
+	if v == nil {
+		return nil
+	}
+	mustCheckRules(reflect.TypeOf(v))
+
+	var errs []FieldError
+	validateValue(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+// RegisterRules checks the "validate" tags of T, and of the types nested in it, and panics if any of them is invalid,
+// like an unknown rule or one that does not apply to the type of its field.
+//
+// It is meant to be called from an init function for every request body type, so that mistakes are caught at startup
+// instead of by the first request.
+func RegisterRules[T any]() {
+	mustCheckRules(reflect.TypeFor[T]())
+}
+
+// checkedTypes caches the result of checkRules per type, so that the tags of a type are parsed only once.
+var checkedTypes sync.Map // reflect.Type -> error (nil if the tags are valid)
+
+// mustCheckRules panics if the validation tags of the given type are invalid.
+func mustCheckRules(t reflect.Type) {
+	result, checked := checkedTypes.Load(t)
+	if !checked {
+		result, _ = checkedTypes.LoadOrStore(t, checkRules(t, map[reflect.Type]bool{}))
+	}
+	if err, _ := result.(error); err != nil {
+		panic(err.Error())
+	}
+}
+
+// checkRules returns an error if the validation tags of the given type, or of the types nested in it, are invalid.
+// The seen types are skipped, so that recursive types terminate.
+func checkRules(t reflect.Type, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if err := checkRule(field.Type, rule); err != nil {
+					return fmt.Errorf("invalid validation rule %q of field %s.%s: %w", rule, t.Name(), field.Name, err)
+				}
+			}
+		}
+		if err := checkRules(field.Type, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRule returns an error if the rule is unknown, malformed, or does not apply to the given field type.
+func checkRule(t reflect.Type, rule string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	name, param, _ := strings.Cut(rule, "=")
+	switch name {
+	case "required":
+	case "min", "max":
+		if _, err := strconv.ParseFloat(param, 64); err != nil {
+			return fmt.Errorf("bound must be a number")
+		}
+		if !measurable(t.Kind()) {
+			return fmt.Errorf("rule does not apply to %s", t.Kind())
+		}
+	case "email":
+		if t.Kind() != reflect.String {
+			return fmt.Errorf("rule does not apply to %s", t.Kind())
+		}
+	case "oneof":
+		if len(strings.Fields(param)) == 0 {
+			return fmt.Errorf("values are required")
+		}
+	default:
+		return fmt.Errorf("unknown rule")
+	}
+	return nil
+}
+
+// validateValue validates the fields of the given value if it is a struct, or of its elements if it is a slice.
+func validateValue(value reflect.Value, path string, errs *[]FieldError) {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		// The dynamic types of interfaces are only known now.
+		if value.Kind() == reflect.Interface {
+			mustCheckRules(value.Elem().Type())
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+	case reflect.Slice, reflect.Array:
+		for i := range value.Len() {
+			validateValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+		return
+	default:
+		return
+	}
+
+	for i := range value.NumField() {
+		field := value.Type().Field(i)
+		// Fields ignored by JSON are never decoded, so there is nothing to validate.
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		// Embedded structs are flattened in JSON.
+		fieldPath := path
+		if !field.Anonymous || field.Tag.Get("json") != "" {
+			fieldPath = joinPath(path, jsonName(field))
+		}
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if err := validateField(value.Field(i), tag); err != nil {
+				err.Field = fieldPath
+				*errs = append(*errs, *err)
+				// Nested fields of an invalid field would only add noise.
+				continue
+			}
+		}
+
+		validateValue(value.Field(i), fieldPath, errs)
+	}
+}
+
+// validateField checks the given field against the rules in its tag, and returns the first one that failed. The rules
+// must have been checked with checkRules.
+func validateField(value reflect.Value, tag string) *FieldError {
+	rules := strings.Split(tag, ",")
+	required := slices.Contains(rules, "required")
+
+	if isMissing(value) {
+		if required {
+			return &FieldError{Rule: "required", Message: "is required"}
+		}
+		// Optional fields that are absent are valid.
+		return nil
+	}
+	// Fields that cannot be missing fail the required rule with their zero value.
+	if required && value.Kind() != reflect.Pointer && (value.IsZero() || isEmpty(value)) {
+		return &FieldError{Rule: "required", Message: "is required"}
+	}
+
+	for value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+
+	for _, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		bound, _ := strconv.ParseFloat(param, 64)
+
+		var message string
+		switch name {
+		case "min":
+			if measure(value) < bound {
+				message = "must be at least " + param + unit(value)
+			}
+		case "max":
+			if measure(value) > bound {
+				message = "must be at most " + param + unit(value)
+			}
+		case "email":
+			address, err := mail.ParseAddress(value.String())
+			if err != nil || address.Address != value.String() {
+				message = "must be a valid email address"
+			}
+		case "oneof":
+			options := strings.Fields(param)
+			if !slices.Contains(options, fmt.Sprint(value.Interface())) {
+				message = "must be one of: " + strings.Join(options, ", ")
+			}
+		}
+
+		if message != "" {
+			return &FieldError{Rule: name, Message: message}
+		}
+	}
+
+	return nil
+}
+
+// isMissing reports whether the field is absent from the JSON body, which can only be told for nil pointers, slices
+// and maps.
+func isMissing(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+		return value.IsNil()
+	default:
+		return false
+	}
+}
+
+// isEmpty reports whether the value is an empty slice or map, which count as absent like nil ones.
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return false
+	}
+}
+
+// measurable reports whether the min and max rules apply to values of the given kind.
+func measurable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return true
+	default:
+		return false
+	}
+}
+
+// measure returns what the min and max rules compare: the value of numbers, and the length of everything else.
+func measure(value reflect.Value) float64 {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String()))
+	default:
+		return float64(value.Len())
+	}
+}
+
+// unit returns the unit of the measure of the value, for error messages.
+func unit(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.String:
+		return " characters long"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return " items long"
+	default:
+		return ""
+	}
+}
+
+// jsonName returns the name of the field in JSON. Fields tagged "-" are skipped by the callers, but "-," names a field
+// "-".
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// joinPath appends the field name to the path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -34,6 +34,12 @@ func (r *ResponseWriterWithCode) Flush() {
 	}
 }
 
+// Unwrap returns the underlying http.ResponseWriter. It allows http.ResponseController to reach the features of the
+// underlying writer, like read and write deadlines.
+func (r *ResponseWriterWithCode) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // Hijack method belongs to the http.Hijacker interface. It is necessary when working with websockets.
 func (r *ResponseWriterWithCode) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	// Get the underlying hijacker interface.
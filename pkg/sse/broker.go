@@ -0,0 +1,311 @@
+package sse
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+// ErrTooSlow is returned when a subscriber falls too far behind the events of its topic. The client can reconnect and
+// resume from its Last-Event-ID, as long as the missed events are still in the replay buffer.
+var ErrTooSlow = errors.New("sse subscriber is too slow")
+
+// subscriberBuffer is the number of events that a subscriber can fall behind before it is dropped.
+const subscriberBuffer = 64
+
+const (
+	// defaultReplayTTL is how long the events of a topic without subscribers are kept, unless the options say
+	// otherwise.
+	defaultReplayTTL = 10 * time.Minute
+	// sweepInterval is how often the idle topics are looked for.
+	sweepInterval = time.Minute
+)
+
+// BrokerOptions configures a Broker.
+type BrokerOptions struct {
+	// ReplaySize is the number of recent events kept per topic, for clients that reconnect with a Last-Event-ID.
+	// Zero disables replay.
+	ReplaySize int
+	// ReplayTTL is how long the events of a topic without subscribers are kept after the last one is published. The
+	// topic is forgotten after that. Zero means 10 minutes.
+	ReplayTTL time.Duration
+	// Writer configures the streams served by the broker.
+	Writer Options
+}
+
+// Broker fans out the events published on a topic to its subscribers. It is safe for concurrent use.
+//
+// The broker assigns increasing IDs to the events, so that a client that reconnects with the ID of the last event it
+// got receives the events it missed. The events live in memory, so the IDs start with an epoch that is random for
+// every broker. A client that reconnects to another instance, or after a restart, has an ID of another epoch, and gets
+// all the events in the replay buffer instead.
+//
+// Topics exist while they have subscribers, or events to replay. Publishing on a topic without either is a no-op.
+type Broker struct {
+	options BrokerOptions
+	epoch   string
+
+	mutex     sync.Mutex
+	topics    map[string]*topic
+	lastSeq   uint64
+	nextSweep time.Time
+	closed    bool
+
+	// Controllable clock for tests.
+	now func() time.Time
+}
+
+// topic is the state of a topic in a Broker.
+type topic struct {
+	// The most recent events, oldest first.
+	replay []replayEvent
+	// When the last event was published, so that idle topics can be forgotten.
+	lastPublish time.Time
+	subscribers map[*Subscription]struct{}
+}
+
+// replayEvent is an event kept for replay, with the sequence number of its ID.
+type replayEvent struct {
+	seq   uint64
+	event Event
+}
+
+// Subscription receives the events of a topic.
+type Subscription struct {
+	broker *Broker
+	topic  string
+	events chan Event
+	// Why the subscription ended. Guarded by the broker's mutex.
+	err error
+}
+
+// NewBroker returns a new Broker.
+func NewBroker(options BrokerOptions) *Broker {
+	if options.ReplayTTL <= 0 {
+		options.ReplayTTL = defaultReplayTTL
+	}
+	return &Broker{
+		options: options,
+		epoch:   strconv.FormatUint(rand.Uint64(), 36),
+		topics:  map[string]*topic{},
+		now:     time.Now,
+	}
+}
+
+// Publish sends the event to the subscribers of the topic, and keeps it for replay. The event's ID is replaced with the
+// next ID of the broker, which is returned. Events published after Close are dropped.
+//
+// Publish never blocks on subscribers. Those that have fallen too far behind are dropped with ErrTooSlow.
+func (b *Broker) Publish(topicName string, event Event) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ""
+	}
+
+	now := b.now()
+	b.sweep(now)
+
+	b.lastSeq++
+	event.ID = b.epoch + "-" + strconv.FormatUint(b.lastSeq, 10)
+
+	// Without replay, the event is only of interest to the current subscribers, if any.
+	t, exists := b.topics[topicName]
+	if !exists && b.options.ReplaySize == 0 {
+		return event.ID
+	}
+	if !exists {
+		t = b.topic(topicName)
+	}
+	t.lastPublish = now
+
+	if b.options.ReplaySize > 0 {
+		if len(t.replay) == b.options.ReplaySize {
+			t.replay = append(t.replay[:0], t.replay[1:]...)
+		}
+		t.replay = append(t.replay, replayEvent{seq: b.lastSeq, event: event})
+	}
+
+	for subscription := range t.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			b.end(subscription, ErrTooSlow)
+		}
+	}
+	return event.ID
+}
+
+// Subscribe returns a subscription to the topic. If lastEventID is not empty, the events after it are replayed first.
+// An ID that the broker did not assign, like one from another instance or from before a restart, replays all the
+// events in the buffer.
+//
+// It returns ErrClosed if the broker is closed. The subscription must be closed once it is no longer needed.
+func (b *Broker) Subscribe(topicName, lastEventID string) (*Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	b.sweep(b.now())
+	t := b.topic(topicName)
+
+	var missed []replayEvent
+	if lastEventID != "" {
+		missed = t.replay
+		if lastSeq, ok := b.parseID(lastEventID); ok {
+			// The buffer is ordered by sequence number.
+			start := len(t.replay)
+			for start > 0 && t.replay[start-1].seq > lastSeq {
+				start--
+			}
+			missed = t.replay[start:]
+		}
+	}
+
+	subscription := &Subscription{
+		broker: b,
+		topic:  topicName,
+		events: make(chan Event, len(missed)+subscriberBuffer),
+	}
+	for _, replayed := range missed {
+		subscription.events <- replayed.event
+	}
+
+	t.subscribers[subscription] = struct{}{}
+	return subscription, nil
+}
+
+// Serve streams the events of the topic to the client, until the client is gone, the subscription ends or the broker
+// is closed. Clients that reconnect with a Last-Event-ID header get the events they missed first.
+//
+// It returns why the stream ended. Routes that call it must be exempt from the request timeout.
+func (b *Broker) Serve(writer http.ResponseWriter, r *http.Request, topicName string) error {
+	subscription, err := b.Subscribe(topicName, r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		httputils.WriteErrorFor(writer, r, httputils.ServiceUnavailable().WithReasonStr("server is shutting down"))
+		return err
+	}
+	defer subscription.Close()
+
+	stream, err := NewWriter(writer, r, b.options.Writer)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for {
+		select {
+		case <-stream.Done():
+			return stream.Err()
+		case event, open := <-subscription.Events():
+			if !open {
+				return subscription.Err()
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close ends all subscriptions with ErrClosed, which ends the streams served by the broker. It is meant to be called
+// when the server shuts down, since the streams would otherwise keep their connections open.
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for _, t := range b.topics {
+		for subscription := range t.subscribers {
+			b.end(subscription, ErrClosed)
+		}
+	}
+}
+
+// topic returns the topic with the given name, creating it if needed. The mutex must be held by the caller.
+func (b *Broker) topic(name string) *topic {
+	t, exists := b.topics[name]
+	if !exists {
+		t = &topic{subscribers: map[*Subscription]struct{}{}}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// parseID returns the sequence number of the event ID, if the ID was assigned by this broker.
+func (b *Broker) parseID(id string) (uint64, bool) {
+	epoch, seqStr, found := strings.Cut(id, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || seq > b.lastSeq {
+		return 0, false
+	}
+	return seq, true
+}
+
+// sweep forgets the topics that have no subscribers, and no event published within the replay TTL. It runs at most
+// once per sweepInterval. The mutex must be held by the caller.
+func (b *Broker) sweep(now time.Time) {
+	if now.Before(b.nextSweep) {
+		return
+	}
+	b.nextSweep = now.Add(sweepInterval)
+
+	for name, t := range b.topics {
+		if len(t.subscribers) == 0 && now.Sub(t.lastPublish) >= b.options.ReplayTTL {
+			delete(b.topics, name)
+		}
+	}
+}
+
+// end removes the subscription from its topic, and closes its channel. The mutex must be held by the caller.
+func (b *Broker) end(subscription *Subscription, err error) {
+	t, exists := b.topics[subscription.topic]
+	if !exists {
+		return
+	}
+	if _, exists := t.subscribers[subscription]; !exists {
+		return
+	}
+
+	delete(t.subscribers, subscription)
+	subscription.err = err
+	close(subscription.events)
+
+	// Topics without subscribers are only kept for their replay buffer.
+	if len(t.subscribers) == 0 && len(t.replay) == 0 {
+		delete(b.topics, subscription.topic)
+	}
+}
+
+// Events returns the channel of the subscription's events. It is closed when the subscription ends, and Err tells why.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns why the subscription ended: ErrClosed if it was closed, or ErrTooSlow. It returns nil while the
+// subscription is active.
+func (s *Subscription) Err() error {
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+	return s.err
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+	s.broker.end(s, ErrClosed)
+}
@@ -0,0 +1,205 @@
+// Package sse implements Server-Sent Events: a Writer that streams events to a client, and a Broker that fans out
+// events published on topics to the subscribed clients, with a replay buffer so that reconnecting clients can resume
+// from their Last-Event-ID.
+//
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when the stream or the broker is closed by the server.
+var ErrClosed = errors.New("sse stream is closed")
+
+// Event is a server-sent event.
+type Event struct {
+	// ID lets the client resume after it, through the Last-Event-ID header. Optional. The Broker sets it.
+	ID string
+	// Event is the type of the event, which clients listen to. Clients treat events without a type as "message".
+	Event string
+	// Data is the payload of the event. It may span several lines.
+	Data string
+	// Retry tells the client how long to wait before reconnecting, if the stream is lost. Optional.
+	Retry time.Duration
+}
+
+// Options configures a Writer.
+type Options struct {
+	// Heartbeat is how often a comment is sent to keep the connection alive through proxies that close idle ones.
+	// Zero disables heartbeats.
+	Heartbeat time.Duration
+	// Retry is the reconnection delay sent to the client when the stream starts. Zero leaves it to the client.
+	Retry time.Duration
+}
+
+// Writer streams server-sent events to a client. It is safe for concurrent use.
+//
+// The Writer sends heartbeats in the background, and watches the request context to detect that the client is gone.
+// Done is closed as soon as the stream cannot be written anymore, and Close must be called before the handler returns.
+type Writer struct {
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+
+	mutex sync.Mutex
+	err   error
+	done  chan struct{}
+	// Closed once the background goroutine has exited.
+	stopped chan struct{}
+}
+
+// NewWriter sends the headers of an event stream to the client, and returns a Writer for its events.
+// It returns an error if the response writer does not support flushing, since the events would not reach the client.
+func NewWriter(writer http.ResponseWriter, r *http.Request, options Options) (*Writer, error) {
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Stops reverse proxies like nginx from buffering the events.
+	header.Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	w := &Writer{
+		writer:     writer,
+		controller: http.NewResponseController(writer),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	var err error
+	if options.Retry > 0 {
+		err = w.write("retry: " + strconv.FormatInt(options.Retry.Milliseconds(), 10) + "\n\n")
+	} else {
+		err = w.write("")
+	}
+	if err != nil {
+		close(w.stopped)
+		return nil, fmt.Errorf("failed to start the event stream: %w", err)
+	}
+
+	go w.watch(r, options.Heartbeat)
+	return w, nil
+}
+
+// Send writes the event to the client. It returns an error if the event is invalid, or if the stream is done.
+func (w *Writer) Send(event Event) error {
+	if strings.ContainsAny(event.ID, "\r\n\x00") {
+		return fmt.Errorf("event id must not contain line breaks or null characters")
+	}
+	if strings.ContainsAny(event.Event, "\r\n") {
+		return fmt.Errorf("event type must not contain line breaks")
+	}
+
+	builder := &strings.Builder{}
+	if event.ID != "" {
+		builder.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		builder.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Retry > 0 {
+		builder.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	// Every line of the data gets its own field, and the client joins them back with line feeds.
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(event.Data)
+	for _, line := range strings.Split(data, "\n") {
+		builder.WriteString("data: " + line + "\n")
+	}
+	builder.WriteString("\n")
+
+	return w.write(builder.String())
+}
+
+// Comment writes a comment, which clients ignore. It can be used to keep the connection alive.
+func (w *Writer) Comment(text string) error {
+	builder := &strings.Builder{}
+	for _, line := range strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text), "\n") {
+		builder.WriteString(": " + line + "\n")
+	}
+	builder.WriteString("\n")
+	return w.write(builder.String())
+}
+
+// Done is closed when the stream cannot be written anymore, because the client is gone, a write failed, or the Writer
+// is closed. Err tells which.
+func (w *Writer) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns why the stream is done, or nil if it is not.
+func (w *Writer) Err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+// Close stops the heartbeats. It does not end the response, which ends when the handler returns.
+func (w *Writer) Close() {
+	w.mutex.Lock()
+	w.finish(ErrClosed)
+	w.mutex.Unlock()
+
+	<-w.stopped
+}
+
+// watch sends the heartbeats, and finishes the stream when the client is gone.
+func (w *Writer) watch(r *http.Request, heartbeat time.Duration) {
+	defer close(w.stopped)
+
+	// A nil channel blocks forever, so no heartbeats are sent if they are disabled.
+	var ticks <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-r.Context().Done():
+			w.mutex.Lock()
+			w.finish(fmt.Errorf("client is gone: %w", r.Context().Err()))
+			w.mutex.Unlock()
+			return
+		case <-ticks:
+			_ = w.write(":\n\n")
+		}
+	}
+}
+
+// write sends the given text to the client, and flushes it. A failure finishes the stream.
+func (w *Writer) write(text string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err := w.writer.Write([]byte(text)); err != nil {
+		w.finish(fmt.Errorf("failed to write to the event stream: %w", err))
+		return w.err
+	}
+	if err := w.controller.Flush(); err != nil {
+		w.finish(fmt.Errorf("failed to flush the event stream: %w", err))
+		return w.err
+	}
+	return nil
+}
+
+// finish marks the stream as done, for the given reason. Only the first reason is kept.
+// The mutex must be held by the caller.
+func (w *Writer) finish(err error) {
+	if w.err != nil {
+		return
+	}
+	w.err = err
+	close(w.done)
+}
@@ -0,0 +1,242 @@
+package sse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncRecorder is an httptest.ResponseRecorder that can be read while the stream is being written.
+type syncRecorder struct {
+	mutex    sync.Mutex
+	recorder *httptest.ResponseRecorder
+}
+
+func newSyncRecorder() *syncRecorder {
+	return &syncRecorder{recorder: httptest.NewRecorder()}
+}
+
+func (s *syncRecorder) Header() http.Header { return s.recorder.Header() }
+
+func (s *syncRecorder) WriteHeader(code int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recorder.WriteHeader(code)
+}
+
+func (s *syncRecorder) Write(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.recorder.Write(b)
+}
+
+func (s *syncRecorder) Flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recorder.Flush()
+}
+
+func (s *syncRecorder) body() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.recorder.Body.String()
+}
+
+func TestWriter(t *testing.T) {
+	recorder := newSyncRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/events", nil)
+
+	writer, err := NewWriter(recorder, request, Options{Retry: 3 * time.Second})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	require.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+	require.Equal(t, "no-cache", recorder.Header().Get("Cache-Control"))
+
+	require.NoError(t, writer.Send(Event{ID: "7", Event: "order", Data: "line 1\r\nline 2"}))
+	require.NoError(t, writer.Send(Event{Data: ""}))
+	require.NoError(t, writer.Comment("hello"))
+	require.Error(t, writer.Send(Event{ID: "7\n"}))
+	require.Error(t, writer.Send(Event{Event: "order\ncreated"}))
+
+	expected := "retry: 3000\n\n" +
+		"id: 7\nevent: order\ndata: line 1\ndata: line 2\n\n" +
+		"data: \n\n" +
+		": hello\n\n"
+	require.Equal(t, expected, recorder.body())
+
+	writer.Close()
+	require.ErrorIs(t, writer.Send(Event{Data: "late"}), ErrClosed)
+}
+
+func TestWriter_HeartbeatAndDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recorder := newSyncRecorder()
+	request := httptest.NewRequestWithContext(ctx, http.MethodGet, "/events", nil)
+
+	writer, err := NewWriter(recorder, request, Options{Heartbeat: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	require.Eventually(t, func() bool { return strings.Contains(recorder.body(), ":\n\n") },
+		time.Second, 5*time.Millisecond)
+
+	// The client is gone.
+	cancel()
+	select {
+	case <-writer.Done():
+	case <-time.After(time.Second):
+		t.Fatal("writer is not done after the client disconnected")
+	}
+	require.ErrorIs(t, writer.Err(), context.Canceled)
+	require.ErrorIs(t, writer.Send(Event{Data: "late"}), context.Canceled)
+}
+
+func TestBroker_Replay(t *testing.T) {
+	broker := NewBroker(BrokerOptions{ReplaySize: 3})
+	defer broker.Close()
+
+	var ids []string
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		ids = append(ids, broker.Publish("orders", Event{Data: data}))
+	}
+	// The IDs are unique across topics, and carry the epoch of the broker.
+	invoiceID := broker.Publish("invoices", Event{Data: "x"})
+	require.Equal(t, broker.epoch+"-5", ids[4])
+	require.Equal(t, broker.epoch+"-6", invoiceID)
+
+	// Another instance, or this one after a restart, has another epoch.
+	other := NewBroker(BrokerOptions{ReplaySize: 3})
+	defer other.Close()
+	foreignID := other.Publish("orders", Event{Data: "z"})
+
+	testCases := []struct {
+		name        string
+		lastEventID string
+		expected    []string
+	}{
+		{name: "New client", lastEventID: "", expected: nil},
+		{name: "Up to date", lastEventID: ids[4], expected: nil},
+		{name: "Missed some", lastEventID: ids[2], expected: []string{"d", "e"}},
+		{name: "Missed more than the buffer", lastEventID: ids[0], expected: []string{"c", "d", "e"}},
+		{name: "ID of another topic", lastEventID: invoiceID, expected: nil},
+		{name: "Unknown ID", lastEventID: broker.epoch + "-42", expected: []string{"c", "d", "e"}},
+		{name: "Other epoch", lastEventID: foreignID, expected: []string{"c", "d", "e"}},
+		{name: "Malformed ID", lastEventID: "abc", expected: []string{"c", "d", "e"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			subscription, err := broker.Subscribe("orders", tc.lastEventID)
+			require.NoError(t, err)
+			defer subscription.Close()
+
+			var received []string
+			for len(subscription.Events()) > 0 {
+				received = append(received, (<-subscription.Events()).Data)
+			}
+			require.Equal(t, tc.expected, received)
+		})
+	}
+}
+
+func TestBroker_Topics(t *testing.T) {
+	// Without replay, events published on a topic without subscribers go nowhere.
+	broker := NewBroker(BrokerOptions{})
+	require.NotEmpty(t, broker.Publish("orders", Event{Data: "a"}))
+	require.Empty(t, broker.topics)
+
+	subscription, err := broker.Subscribe("orders", "")
+	require.NoError(t, err)
+	require.Len(t, broker.topics, 1)
+	subscription.Close()
+	require.Empty(t, broker.topics)
+
+	// With replay, topics without subscribers are kept for their events, until they are idle for the TTL.
+	now := time.Now()
+	broker = NewBroker(BrokerOptions{ReplaySize: 10, ReplayTTL: time.Hour})
+	broker.now = func() time.Time { return now }
+
+	broker.Publish("orders", Event{Data: "a"})
+	now = now.Add(30 * time.Minute)
+	broker.Publish("invoices", Event{Data: "b"})
+	require.Len(t, broker.topics, 2)
+
+	now = now.Add(45 * time.Minute)
+	broker.Publish("invoices", Event{Data: "c"})
+	require.Len(t, broker.topics, 1)
+	require.Contains(t, broker.topics, "invoices")
+}
+
+func TestBroker_Subscribers(t *testing.T) {
+	broker := NewBroker(BrokerOptions{})
+
+	fast, err := broker.Subscribe("orders", "")
+	require.NoError(t, err)
+	slow, err := broker.Subscribe("orders", "")
+	require.NoError(t, err)
+
+	// The slow subscriber never reads, so it is dropped once its buffer is full.
+	for i := range subscriberBuffer + 1 {
+		broker.Publish("orders", Event{Data: "event"})
+		if i < subscriberBuffer {
+			<-fast.Events()
+		}
+	}
+	<-fast.Events()
+	require.Nil(t, fast.Err())
+
+	require.Len(t, slow.Events(), subscriberBuffer)
+	require.ErrorIs(t, slow.Err(), ErrTooSlow)
+
+	// Closing the broker ends the remaining subscriptions, and refuses new ones.
+	broker.Close()
+	_, open := <-fast.Events()
+	require.False(t, open)
+	require.ErrorIs(t, fast.Err(), ErrClosed)
+
+	_, err = broker.Subscribe("orders", "")
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestBroker_Serve(t *testing.T) {
+	broker := NewBroker(BrokerOptions{ReplaySize: 10})
+	broker.Publish("orders", Event{Event: "created", Data: "1"})
+
+	recorder := newSyncRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/events", nil)
+	request.Header.Set("Last-Event-ID", "0")
+
+	served := make(chan error)
+	go func() { served <- broker.Serve(recorder, request, "orders") }()
+
+	require.Eventually(t, func() bool { return strings.Contains(recorder.body(), "data: 1\n") },
+		time.Second, 5*time.Millisecond)
+
+	id := broker.Publish("orders", Event{Event: "created", Data: "2"})
+	require.Eventually(t, func() bool {
+		return strings.Contains(recorder.body(), "id: "+id+"\nevent: created\ndata: 2\n")
+	}, time.Second, 5*time.Millisecond)
+
+	// The shutdown ends the stream.
+	broker.Close()
+	select {
+	case err := <-served:
+		require.ErrorIs(t, err, ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("stream did not end after the broker was closed")
+	}
+
+	// Later clients are refused.
+	rejected := httptest.NewRecorder()
+	require.ErrorIs(t, broker.Serve(rejected, request, "orders"), ErrClosed)
+	require.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+}
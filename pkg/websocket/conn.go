@@ -0,0 +1,361 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Frame opcodes, as per RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxControlPayload is the max payload size of control frames, like pings and close frames.
+const maxControlPayload = 125
+
+// closeTimeout is how long Close waits for the close frame of the client before closing the connection anyway.
+const closeTimeout = 5 * time.Second
+
+// ErrClosed is returned when writing to a connection after its close frame is sent.
+var ErrClosed = errors.New("websocket connection is closed")
+
+// CloseError is returned by ReadMessage when the connection is closed with a close frame, by the client, or by the
+// server because the client broke the protocol or the limits.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a websocket connection. Its methods are safe for concurrent use, except ReadMessage, which must be called by
+// a single goroutine.
+//
+// The connection must be read continuously with ReadMessage, even if the messages are of no interest, since it also
+// answers the pings and the close frame of the client. Once ReadMessage returns an error, the connection is closed.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	options Options
+
+	// Guards the writes, since pings and broadcasts write concurrently with the handler.
+	writeMutex sync.Mutex
+	// No frame may follow a close frame.
+	closeSent atomic.Bool
+
+	// Closed once the network connection is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// frame is a received websocket frame, unmasked.
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// newConn returns a Conn over the given network connection, and starts its keepalive pings.
+func newConn(netConn net.Conn, reader *bufio.Reader, options Options) *Conn {
+	c := &Conn{conn: netConn, reader: reader, options: options, closed: make(chan struct{})}
+	if options.PingInterval > 0 {
+		go c.keepAlive()
+	}
+	return c
+}
+
+// ReadMessage returns the next data message. Pings are answered, pongs are skipped, and fragmented messages are
+// joined while it waits.
+//
+// It returns a *CloseError when the connection is closed with a close frame, and other errors if the connection is
+// lost or dead. Either way, the connection is closed by then.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+
+	for {
+		f, err := c.readFrame(c.options.MaxMessageSize - int64(len(message)))
+		if err != nil {
+			var errClose *CloseError
+			if errors.As(err, &errClose) {
+				return 0, nil, c.fail(errClose)
+			}
+			c.closeConn()
+			return 0, nil, fmt.Errorf("failed to read frame: %w", err)
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			// Receiving it has already extended the read deadline.
+			continue
+		case opClose:
+			return 0, nil, c.receiveClose(f.payload)
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"})
+			}
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "expected continuation frame"})
+			}
+			messageType = MessageType(f.opcode)
+		default:
+			return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unknown opcode"})
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "text message is not valid UTF-8"})
+		}
+		return messageType, message, nil
+	}
+}
+
+// WriteMessage sends a data message in a single frame. Text messages must be valid UTF-8.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	switch messageType {
+	case TextMessage:
+		if !utf8.Valid(data) {
+			return fmt.Errorf("text message must be valid UTF-8")
+		}
+	case BinaryMessage:
+	default:
+		return fmt.Errorf("unknown message type: %d", messageType)
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+// Close starts the closing handshake with the given code and reason. The client answers with its own close frame,
+// which ReadMessage receives before it closes the connection. If it does not answer in time, the connection is closed
+// anyway. Calling Close again is a no-op.
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.writeFrame(opClose, closePayload(code, reason)); err != nil {
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+		return err
+	}
+
+	// Wakes up ReadMessage if the client never answers.
+	_ = c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	time.AfterFunc(closeTimeout, c.closeConn)
+	return nil
+}
+
+// Done is closed once the network connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// RemoteAddr returns the network address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// keepAlive pings the client periodically, until the connection is closed.
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(c.options.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(opPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads the next frame, with a data payload of up to limit bytes.
+// Violations of the protocol and the limit are returned as a *CloseError with the code to close the connection with.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	// Any frame, including pongs, shows that the client is alive. After the close frame is sent, the deadline is the
+	// one set by Close.
+	if c.options.PingInterval > 0 && !c.closeSent.Load() {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.options.PingInterval + c.options.PongTimeout))
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F}
+	if header[0]&0x70 != 0 {
+		// No extensions are negotiated, so the reserved bits must be zero.
+		return f, &CloseError{Code: CloseProtocolError, Reason: "reserved bits are set"}
+	}
+	if header[1]&0x80 == 0 {
+		return f, &CloseError{Code: CloseProtocolError, Reason: "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	isControl := f.opcode >= opClose
+	switch {
+	case isControl && (!f.fin || length > maxControlPayload):
+		return f, &CloseError{Code: CloseProtocolError, Reason: "control frames must not be fragmented or large"}
+	case !isControl && length > uint64(max(limit, 0)):
+		// Checked before reading the payload, so that it is never held in memory.
+		return f, &CloseError{Code: CloseMessageTooBig, Reason: "message is too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return f, err
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// writeFrame sends an unfragmented, unmasked frame. It returns ErrClosed if the close frame is already sent.
+// A failed write closes the connection, since the client can no longer make sense of the stream.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent.Load() {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent.Store(true)
+	}
+
+	buffer := make([]byte, 0, 10+len(payload))
+	buffer = append(buffer, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		buffer = append(buffer, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		buffer = append(buffer, 126)
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(payload)))
+	default:
+		buffer = append(buffer, 127)
+		buffer = binary.BigEndian.AppendUint64(buffer, uint64(len(payload)))
+	}
+	buffer = append(buffer, payload...)
+
+	if c.options.WriteTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+	}
+	if _, err := c.conn.Write(buffer); err != nil {
+		c.closeConn()
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// receiveClose answers the close frame of the client, unless the server closed first, and closes the connection.
+func (c *Conn) receiveClose(payload []byte) error {
+	errClose := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(&CloseError{Code: CloseProtocolError, Reason: "close frame is too short"})
+	case len(payload) >= 2:
+		errClose.Code = int(binary.BigEndian.Uint16(payload))
+		errClose.Reason = string(payload[2:])
+		if !validCloseCode(errClose.Code) {
+			return c.fail(&CloseError{Code: CloseProtocolError, Reason: "close code is invalid"})
+		}
+		if !utf8.ValidString(errClose.Reason) {
+			return c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "close reason is not valid UTF-8"})
+		}
+	}
+
+	// The code of the client is echoed, as per RFC 6455 section 5.5.1.
+	var reply []byte
+	if errClose.Code != CloseNoStatus {
+		reply = closePayload(errClose.Code, "")
+	}
+	_ = c.writeFrame(opClose, reply)
+
+	c.closeConn()
+	return errClose
+}
+
+// fail sends a close frame for the given error, if none is sent yet, and closes the connection.
+func (c *Conn) fail(errClose *CloseError) error {
+	_ = c.writeFrame(opClose, closePayload(errClose.Code, errClose.Reason))
+	c.closeConn()
+	return errClose
+}
+
+// closeConn closes the network connection. It is safe to call more than once.
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() {
+		_ = c.conn.Close()
+		close(c.closed)
+	})
+}
+
+// closePayload encodes the payload of a close frame. The reason is cut short to fit in a control frame.
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	for _, r := range reason {
+		if len(payload)+utf8.RuneLen(r) > maxControlPayload {
+			break
+		}
+		payload = utf8.AppendRune(payload, r)
+	}
+	return payload
+}
+
+// validCloseCode reports whether the code may be sent in a close frame, as per RFC 6455 section 7.4.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= closeMinApplicationID && code <= closeMaxApplicationID:
+		return true
+	case code < CloseNormal, code > 1014:
+		return false
+	}
+	// These are reserved for reporting, and never sent.
+	return code != 1004 && code != CloseNoStatus && code != 1006
+}
@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+)
+
+// sendQueueSize is the number of messages that a connection of a Hub can fall behind before it is dropped.
+const sendQueueSize = 64
+
+// message is a data message queued for a connection.
+type message struct {
+	messageType MessageType
+	data        []byte
+}
+
+// member is a connection of a Hub.
+type member struct {
+	conn  *Conn
+	send  chan message
+	rooms map[string]struct{}
+	// The close frame that is sent once the queue is drained. Zero if the connection is left to its handler.
+	closeCode   int
+	closeReason string
+}
+
+// Hub broadcasts messages to its connections, either all of them or the members of a room. It is safe for concurrent
+// use.
+//
+// Every connection has a queue, so that a slow client does not hold back the others. Connections whose queue is full
+// are closed with CloseTryAgainLater.
+type Hub struct {
+	mutex   sync.Mutex
+	members map[*Conn]*member
+	rooms   map[string]map[*Conn]struct{}
+	closed  bool
+	// Tracks the goroutines that write the queues, so that Close can wait for the close frames.
+	pumps sync.WaitGroup
+}
+
+// NewHub returns a new Hub.
+func NewHub() *Hub {
+	return &Hub{members: map[*Conn]*member{}, rooms: map[string]map[*Conn]struct{}{}}
+}
+
+// Add adds the connection to the hub. The handler must still read the connection, and Remove it once ReadMessage
+// fails.
+//
+// If the hub is closed, the connection is closed with CloseGoingAway, and ErrClosed is returned.
+func (h *Hub) Add(conn *Conn) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		_ = conn.Close(CloseGoingAway, "server is shutting down")
+		return ErrClosed
+	}
+	if _, exists := h.members[conn]; exists {
+		return nil
+	}
+
+	m := &member{conn: conn, send: make(chan message, sendQueueSize), rooms: map[string]struct{}{}}
+	h.members[conn] = m
+
+	h.pumps.Add(1)
+	go h.pump(m)
+	return nil
+}
+
+// Remove removes the connection from the hub and its rooms. It does not close the connection.
+func (h *Hub) Remove(conn *Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if m, exists := h.members[conn]; exists {
+		h.remove(m)
+	}
+}
+
+// Join adds the connection to the room. The connection must be added to the hub first.
+func (h *Hub) Join(conn *Conn, room string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m, exists := h.members[conn]
+	if !exists {
+		return
+	}
+
+	m.rooms[room] = struct{}{}
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*Conn]struct{}{}
+	}
+	h.rooms[room][conn] = struct{}{}
+}
+
+// Leave removes the connection from the room.
+func (h *Hub) Leave(conn *Conn, room string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if m, exists := h.members[conn]; exists {
+		h.leave(m, room)
+	}
+}
+
+// Broadcast queues the message for all connections of the hub.
+func (h *Hub) Broadcast(messageType MessageType, data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, m := range h.members {
+		h.enqueue(m, message{messageType: messageType, data: data})
+	}
+}
+
+// BroadcastTo queues the message for the connections in the room.
+func (h *Hub) BroadcastTo(room string, messageType MessageType, data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for conn := range h.rooms[room] {
+		h.enqueue(h.members[conn], message{messageType: messageType, data: data})
+	}
+}
+
+// Close sends a close frame with CloseGoingAway to all connections, once their queued messages are sent, and waits
+// until the clients close them or the context is done. Connections that are still open by then are closed abruptly.
+// Later connections are refused by Add.
+func (h *Hub) Close(ctx context.Context) error {
+	h.mutex.Lock()
+	h.closed = true
+	conns := make([]*Conn, 0, len(h.members))
+	for conn, m := range h.members {
+		m.closeCode, m.closeReason = CloseGoingAway, "server is shutting down"
+		h.remove(m)
+		conns = append(conns, conn)
+	}
+	h.mutex.Unlock()
+
+	// The connections close as their handlers receive the answers of the clients, or after the close timeout.
+	for _, conn := range conns {
+		select {
+		case <-conn.Done():
+		case <-ctx.Done():
+			for _, conn := range conns {
+				conn.closeConn()
+			}
+			return ctx.Err()
+		}
+	}
+
+	h.pumps.Wait()
+	return nil
+}
+
+// pump writes the queued messages of the member to its connection, until the member is removed.
+func (h *Hub) pump(m *member) {
+	defer h.pumps.Done()
+
+	for msg := range m.send {
+		if err := m.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			// The connection is closed by the failed write, and its handler removes it once its read fails too.
+			h.Remove(m.conn)
+			return
+		}
+	}
+
+	// Set before the queue was closed, so it is safe to read.
+	if m.closeCode != 0 {
+		_ = m.conn.Close(m.closeCode, m.closeReason)
+	}
+}
+
+// enqueue queues the message for the member, or drops the member if its queue is full. The mutex must be held by the
+// caller.
+func (h *Hub) enqueue(m *member, msg message) {
+	select {
+	case m.send <- msg:
+	default:
+		m.closeCode, m.closeReason = CloseTryAgainLater, "client is too slow"
+		h.remove(m)
+	}
+}
+
+// remove removes the member from the hub and its rooms, and closes its queue. The mutex must be held by the caller.
+func (h *Hub) remove(m *member) {
+	for room := range m.rooms {
+		h.leave(m, room)
+	}
+	delete(h.members, m.conn)
+	close(m.send)
+}
+
+// leave removes the member from the room, and the room if it is empty. The mutex must be held by the caller.
+func (h *Hub) leave(m *member, room string) {
+	delete(m.rooms, room)
+	delete(h.rooms[room], m.conn)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
@@ -0,0 +1,164 @@
+// Package websocket implements the server side of the WebSocket protocol, with ping/pong keepalive and message size
+// limits, and a Hub that broadcasts messages to all connections or to rooms of them.
+//
+// https://www.rfc-editor.org/rfc/rfc6455
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shivanshkc/squelette/pkg/httputils"
+)
+
+// acceptGUID is appended to the key of the client to compute the Sec-WebSocket-Accept header, as per RFC 6455.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// defaultMaxMessageSize is the max size of a received message, unless the options say otherwise.
+const defaultMaxMessageSize = 64 << 10 // 64 KB
+
+// MessageType is the type of a data message. Its values are the opcodes of the frames.
+type MessageType int
+
+const (
+	TextMessage   MessageType = opText
+	BinaryMessage MessageType = opBinary
+)
+
+// Close codes, as per RFC 6455 section 7.4.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	// CloseNoStatus is reported when the close frame has no code. It is never sent.
+	CloseNoStatus         = 1005
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+	CloseTryAgainLater    = 1013
+	closeMinApplicationID = 3000
+	closeMaxApplicationID = 4999
+)
+
+// Options configures the connections made by Upgrade.
+type Options struct {
+	// CheckOrigin reports whether the request may open a connection. Browsers let any page open a websocket to any
+	// host, with the user's cookies, so this guards against cross-site websocket hijacking. If nil, only the requests
+	// from the same origin, and those without an Origin header, like non-browser clients, are accepted.
+	CheckOrigin func(r *http.Request) bool
+	// MaxMessageSize is the max size of a received message, in bytes. Larger messages close the connection with
+	// CloseMessageTooBig. Zero means 64 KB.
+	MaxMessageSize int64
+	// PingInterval is how often the client is pinged. A connection that receives nothing, not even a pong, for
+	// PingInterval plus PongTimeout is considered dead. Zero disables the pings and the timeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// WriteTimeout bounds every write to the connection. Zero means no timeout.
+	WriteTimeout time.Duration
+}
+
+// Upgrade completes the websocket handshake of the request, and returns the connection. The route must be exempt from
+// the read and write deadlines, since the connection outlives them.
+//
+// If the request is not a valid handshake, or its origin is not allowed, an error response is written, and the error
+// is returned. The handler must not write to the response writer after a successful upgrade.
+func Upgrade(writer http.ResponseWriter, r *http.Request, options Options) (*Conn, error) {
+	if errHTTP := checkHandshake(r, options); errHTTP != nil {
+		if errHTTP.StatusCode == http.StatusUpgradeRequired {
+			writer.Header().Set("Sec-WebSocket-Version", "13")
+		}
+		httputils.WriteErrorFor(writer, r, errHTTP)
+		return nil, fmt.Errorf("invalid websocket handshake: %w", errHTTP)
+	}
+
+	netConn, readWriter, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		err = fmt.Errorf("failed to hijack the connection: %w", err)
+		httputils.WriteErrorFor(writer, r, httputils.InternalServerError().WithCause(err))
+		return nil, err
+	}
+
+	// The server no longer manages the connection, so the deadlines of the route must not linger.
+	_ = netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+
+	if options.WriteTimeout > 0 {
+		_ = netConn.SetWriteDeadline(time.Now().Add(options.WriteTimeout))
+	}
+	if _, err := netConn.Write([]byte(response)); err != nil {
+		_ = netConn.Close()
+		return nil, fmt.Errorf("failed to write the handshake response: %w", err)
+	}
+
+	if options.MaxMessageSize <= 0 {
+		options.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	// The reader of the hijacked connection may already hold the first frames of the client.
+	return newConn(netConn, readWriter.Reader, options), nil
+}
+
+// checkHandshake returns the error response for the request, if it is not a valid websocket handshake.
+func checkHandshake(r *http.Request, options Options) *httputils.Error {
+	if r.Method != http.MethodGet {
+		return httputils.NewError(http.StatusMethodNotAllowed).WithReasonStr("websocket handshake must use GET")
+	}
+	// HTTP/2 has no Connection and Upgrade headers, and websockets over HTTP/2 (RFC 8441) are not supported.
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return httputils.BadRequest().WithReasonStr("request is not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return httputils.NewError(http.StatusUpgradeRequired).WithReasonStr("websocket version must be 13")
+	}
+	if key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return httputils.BadRequest().WithReasonStr("websocket key is invalid")
+	}
+
+	checkOrigin := options.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return httputils.Forbidden().WithReasonStr("origin is not allowed")
+	}
+	return nil
+}
+
+// sameOrigin reports whether the request has no Origin header, or one with the same host as the request.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// headerHasToken reports whether the comma-separated values of the header contain the token, case-insensitively.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptKey computes the Sec-WebSocket-Accept header for the Sec-WebSocket-Key of the client.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
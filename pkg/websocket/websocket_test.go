@@ -0,0 +1,354 @@
+package websocket
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockClient is a minimal websocket client for the tests.
+type mockClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial opens a websocket connection to the server.
+func dial(t *testing.T, server *httptest.Server) *mockClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	request := "GET / HTTP/1.1\r\nHost: " + server.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	// The example of RFC 6455 section 1.3.
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", response.Header.Get("Sec-WebSocket-Accept"))
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &mockClient{conn: conn, reader: reader}
+}
+
+// writeFrame sends a frame, masked as clients must.
+func (m *mockClient) writeFrame(t *testing.T, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+
+	header := opcode
+	if fin {
+		header |= 0x80
+	}
+	frame := []byte{header}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := m.conn.Write(frame)
+	require.NoError(t, err)
+}
+
+// readFrame reads an unmasked frame from the server.
+func (m *mockClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	_, err := io.ReadFull(m.reader, header[:])
+	require.NoError(t, err)
+	require.NotZero(t, header[0]&0x80, "server frames must not be fragmented")
+	require.Zero(t, header[1]&0x80, "server frames must not be masked")
+
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		_, err := io.ReadFull(m.reader, extended[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(m.reader, payload)
+	require.NoError(t, err)
+	return header[0] & 0x0F, payload
+}
+
+// expectClose reads the next frame, and requires it to be a close frame with the given code.
+func (m *mockClient) expectClose(t *testing.T, code int) {
+	t.Helper()
+
+	opcode, payload := m.readFrame(t)
+	require.Equal(t, byte(opClose), opcode)
+	require.GreaterOrEqual(t, len(payload), 2)
+	require.Equal(t, code, int(binary.BigEndian.Uint16(payload)))
+}
+
+// newEchoServer returns a server that echoes the messages of its websocket connections, and reports the error that
+// ended each of them.
+func newEchoServer(t *testing.T, options Options) (*httptest.Server, chan error) {
+	t.Helper()
+
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, options)
+		if err != nil {
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			_ = conn.WriteMessage(messageType, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, errs
+}
+
+func TestUpgrade_Rejected(t *testing.T) {
+	server, _ := newEchoServer(t, Options{})
+
+	testCases := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		expectedCode int
+	}{
+		{name: "Not GET", method: http.MethodPost, expectedCode: http.StatusMethodNotAllowed},
+		{
+			name:         "Not a handshake",
+			header:       map[string]string{"Connection": "keep-alive"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Old version",
+			header:       map[string]string{"Sec-WebSocket-Version": "8"},
+			expectedCode: http.StatusUpgradeRequired,
+		},
+		{
+			name:         "Invalid key",
+			header:       map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Cross origin",
+			header:       map[string]string{"Origin": "https://evil.example.com"},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request, err := http.NewRequest(cmp.Or(tc.method, http.MethodGet), server.URL, nil)
+			require.NoError(t, err)
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			for key, value := range tc.header {
+				request.Header.Set(key, value)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			require.NoError(t, err)
+			defer func() { _ = response.Body.Close() }()
+			require.Equal(t, tc.expectedCode, response.StatusCode)
+		})
+	}
+}
+
+func TestConn_Messages(t *testing.T) {
+	server, errs := newEchoServer(t, Options{MaxMessageSize: 16})
+	client := dial(t, server)
+
+	// A text message in one frame.
+	client.writeFrame(t, true, opText, []byte("hello"))
+	opcode, payload := client.readFrame(t)
+	require.Equal(t, byte(opText), opcode)
+	require.Equal(t, "hello", string(payload))
+
+	// A fragmented binary message, with a ping in between.
+	client.writeFrame(t, false, opBinary, []byte{1, 2})
+	client.writeFrame(t, true, opPing, []byte("are you there"))
+	client.writeFrame(t, true, opContinuation, []byte{3})
+
+	opcode, payload = client.readFrame(t)
+	require.Equal(t, byte(opPong), opcode)
+	require.Equal(t, "are you there", string(payload))
+
+	opcode, payload = client.readFrame(t)
+	require.Equal(t, byte(opBinary), opcode)
+	require.Equal(t, []byte{1, 2, 3}, payload)
+
+	// The close handshake echoes the code.
+	client.writeFrame(t, true, opClose, closePayload(CloseNormal, "bye"))
+	client.expectClose(t, CloseNormal)
+	require.Equal(t, &CloseError{Code: CloseNormal, Reason: "bye"}, <-errs)
+}
+
+func TestConn_Violations(t *testing.T) {
+	testCases := []struct {
+		name         string
+		write        func(t *testing.T, client *mockClient)
+		expectedCode int
+	}{
+		{
+			name: "Too big",
+			write: func(t *testing.T, client *mockClient) {
+				client.writeFrame(t, false, opText, []byte("0123456789"))
+				client.writeFrame(t, true, opContinuation, []byte("0123456789"))
+			},
+			expectedCode: CloseMessageTooBig,
+		},
+		{
+			name: "Invalid UTF-8",
+			write: func(t *testing.T, client *mockClient) {
+				client.writeFrame(t, true, opText, []byte{0xff, 0xfe})
+			},
+			expectedCode: CloseInvalidPayload,
+		},
+		{
+			name: "Unexpected continuation",
+			write: func(t *testing.T, client *mockClient) {
+				client.writeFrame(t, true, opContinuation, []byte("a"))
+			},
+			expectedCode: CloseProtocolError,
+		},
+		{
+			name: "Unmasked frame",
+			write: func(t *testing.T, client *mockClient) {
+				_, err := client.conn.Write([]byte{0x80 | opText, 1, 'a'})
+				require.NoError(t, err)
+			},
+			expectedCode: CloseProtocolError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, errs := newEchoServer(t, Options{MaxMessageSize: 16})
+			client := dial(t, server)
+
+			tc.write(t, client)
+			client.expectClose(t, tc.expectedCode)
+
+			var errClose *CloseError
+			require.ErrorAs(t, <-errs, &errClose)
+			require.Equal(t, tc.expectedCode, errClose.Code)
+		})
+	}
+}
+
+func TestConn_Keepalive(t *testing.T) {
+	server, errs := newEchoServer(t, Options{PingInterval: 20 * time.Millisecond, PongTimeout: 20 * time.Millisecond})
+	client := dial(t, server)
+
+	// The client answers the first ping, then goes silent.
+	opcode, _ := client.readFrame(t)
+	require.Equal(t, byte(opPing), opcode)
+	client.writeFrame(t, true, opPong, nil)
+
+	select {
+	case err := <-errs:
+		var errNet net.Error
+		require.ErrorAs(t, err, &errNet)
+		require.True(t, errNet.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("silent connection was not dropped")
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, Options{})
+		if err != nil {
+			return
+		}
+		if err := hub.Add(conn); err != nil {
+			return
+		}
+		defer hub.Remove(conn)
+
+		// The first message of the client is the room to join. The others are broadcast to it.
+		_, room, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		hub.Join(conn, string(room))
+		_ = conn.WriteMessage(TextMessage, []byte("joined"))
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			hub.BroadcastTo(string(room), messageType, data)
+		}
+	}))
+	defer server.Close()
+
+	join := func(room string) *mockClient {
+		client := dial(t, server)
+		client.writeFrame(t, true, opText, []byte(room))
+		_, payload := client.readFrame(t)
+		require.Equal(t, "joined", string(payload))
+		return client
+	}
+	alice, bob, carol := join("orders"), join("orders"), join("invoices")
+
+	// Only the members of the room get the message.
+	alice.writeFrame(t, true, opText, []byte("order created"))
+	for _, client := range []*mockClient{alice, bob} {
+		_, payload := client.readFrame(t)
+		require.Equal(t, "order created", string(payload))
+	}
+
+	// All connections get broadcasts.
+	hub.Broadcast(TextMessage, []byte("maintenance"))
+	for _, client := range []*mockClient{alice, bob, carol} {
+		_, payload := client.readFrame(t)
+		require.Equal(t, "maintenance", string(payload))
+	}
+
+	// The shutdown sends close frames, and waits for the clients to answer.
+	closed := make(chan error)
+	go func() { closed <- hub.Close(context.Background()) }()
+	for _, client := range []*mockClient{alice, bob, carol} {
+		client.expectClose(t, CloseGoingAway)
+		client.writeFrame(t, true, opClose, closePayload(CloseGoingAway, ""))
+	}
+	require.NoError(t, <-closed)
+
+	// Later connections are refused.
+	late := dial(t, server)
+	late.expectClose(t, CloseGoingAway)
+}